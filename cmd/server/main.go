@@ -5,11 +5,19 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/n3wscott/cloudevents-discovery/pkg/auth"
 	"github.com/n3wscott/cloudevents-discovery/pkg/background"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client"
 	"github.com/n3wscott/cloudevents-discovery/pkg/handler"
+	"github.com/n3wscott/cloudevents-discovery/pkg/lifecycle"
+	"github.com/n3wscott/cloudevents-discovery/pkg/logging"
+	"github.com/n3wscott/cloudevents-discovery/pkg/metrics"
+	"github.com/n3wscott/cloudevents-discovery/pkg/tracing"
+	"go.uber.org/zap"
 	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
 type envConfig struct {
@@ -17,8 +25,68 @@ type envConfig struct {
 	Port          int    `envconfig:"PORT" default:"8080"`
 	Downstream    string `envconfig:"DISCOVERY_DOWNSTREAM"` // comma separated list of urls.
 	Services      string `envconfig:"DISCOVERY_SERVICES_FILE"`
-	Subscriptions string `envconfig:"SUBSCRIPTIONS_FILE"`
-	Sinks         string `envconfig:"SINK"` // comma separated list of urls.
+	Subscriptions string `envconfig:"SUBSCRIPTIONS_FILE"`    // persist subscriptions to this file, in-memory if unset.
+	Examples      bool   `envconfig:"EXAMPLE_SUBSCRIPTIONS"` // seed the in-memory subscriptions with examples.
+	Sinks         string `envconfig:"SINK"`                  // comma separated list of urls.
+
+	DeliveryMaxAttempts int           `envconfig:"DELIVERY_MAX_ATTEMPTS" default:"3"`
+	DeliveryBackoff     time.Duration `envconfig:"DELIVERY_BACKOFF" default:"1s"`
+	DeliveryTimeout     time.Duration `envconfig:"DELIVERY_TIMEOUT" default:"10s"`
+	DeliveryQueueSize   int           `envconfig:"DELIVERY_QUEUE_SIZE" default:"100"`
+	DeadLetterSink      string        `envconfig:"DEAD_LETTER_SINK"` // url, undeliverable events are dropped if unset.
+	DrainTimeout        time.Duration `envconfig:"DELIVERY_DRAIN_TIMEOUT" default:"10s"`
+
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+
+	LogLevel string `envconfig:"LOG_LEVEL" default:"info"` // debug, info, warn or error.
+
+	TracingExporter string `envconfig:"TRACING_EXPORTER" default:"none"` // none, stdout or otlp.
+
+	// Authentication is enabled if any of tokens, JWKS or client CA are set.
+	AuthTokens      string `envconfig:"AUTH_TOKENS_FILE"` // JSON array of {"token","name","scopes"}.
+	AuthJWKS        string `envconfig:"AUTH_JWKS_FILE"`
+	AuthJWTIssuer   string `envconfig:"AUTH_JWT_ISSUER"`
+	AuthJWTAudience string `envconfig:"AUTH_JWT_AUDIENCE"`
+
+	TLSCert     string `envconfig:"TLS_CERT_FILE"` // serve TLS if set, along with TLS_KEY_FILE.
+	TLSKey      string `envconfig:"TLS_KEY_FILE"`
+	TLSClientCA string `envconfig:"TLS_CLIENT_CA_FILE"` // authenticate client certificates signed by these CAs.
+
+	DownstreamToken string `envconfig:"DISCOVERY_DOWNSTREAM_TOKEN"` // bearer token for the downstreams.
+
+	Aggregation  string        `envconfig:"DISCOVERY_AGGREGATION" default:"poll"` // poll or push.
+	ResyncPeriod time.Duration `envconfig:"DISCOVERY_RESYNC_PERIOD" default:"5m"` // full resync period of push aggregation.
+	PushToken    string        `envconfig:"DISCOVERY_PUSH_TOKEN"`                 // bearer token the downstreams push with.
+}
+
+// authenticator returns the authenticators configured by env, nil if
+// authentication is disabled.
+func authenticator(env envConfig) (auth.Authenticator, error) {
+	chain := auth.Chain{}
+	if env.TLSClientCA != "" {
+		chain = append(chain, auth.ClientCerts{})
+	}
+	if env.AuthTokens != "" {
+		tokens, err := auth.LoadTokens(env.AuthTokens)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, tokens)
+	}
+	if env.AuthJWKS != "" {
+		jwt, err := auth.LoadJWT(env.AuthJWKS, auth.JWTOptions{
+			Issuer:   env.AuthJWTIssuer,
+			Audience: env.AuthJWTAudience,
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, jwt)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
 }
 
 func main() {
@@ -28,50 +96,127 @@ func main() {
 		os.Exit(1)
 	}
 
-	changes := make(chan background.ServiceChange, 10)   // TODO: 10 might be too small of a channel buffer.
+	logger, err := logging.New(env.LogLevel)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create logger: %s", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), env.TracingExporter, "cloudmeta")
+	if err != nil {
+		logger.Fatalw("failed to set up tracing", zap.Error(err))
+	}
+
 	subs := make(chan background.SubscriptionChange, 10) // TODO: 10 might be too small of a channel buffer.
 
-	servicesHandler := handler.NewServiceHandler(changes)
+	mgr := lifecycle.NewManager(env.ShutdownTimeout, logger)
+
+	store := background.NewServiceStore()
+
+	// Start venting before anything is stored so no change is missed.
+	delivery := background.DeliveryConfig{
+		MaxAttempts:    env.DeliveryMaxAttempts,
+		Backoff:        env.DeliveryBackoff,
+		Timeout:        env.DeliveryTimeout,
+		QueueSize:      env.DeliveryQueueSize,
+		DeadLetterSink: env.DeadLetterSink,
+		DrainTimeout:   env.DrainTimeout,
+	}
+	vent, err := background.NewVent(env.Service, env.Sinks, delivery, store.Watch(), subs, logger.Named("vent"))
+	if err != nil {
+		logger.Fatalw("failed to set up delivery", zap.Error(err))
+	}
+	mgr.Start("vent", vent)
+
+	servicesHandler := handler.NewServiceHandler(store)
 	if env.Services != "" {
 		if err := servicesHandler.LoadServicesFromFile(env.Services); err != nil {
-			log.Fatal(err)
+			logger.Fatalw("failed to load services", "file", env.Services, zap.Error(err))
 		}
 	}
 	// Add ourself.
-	servicesHandler.Set(background.Service(env.Service))
+	servicesHandler.Set(context.Background(), background.Service(env.Service))
 
-	subscriptionHandler := handler.NewSubscriptionHandler(subs)
+	typesHandler := handler.NewTypesHandler(servicesHandler)
+
+	var subStore background.SubscriptionStore
+	if env.Subscriptions != "" {
+		if subStore, err = background.NewFileSubscriptionStore(env.Subscriptions); err != nil {
+			logger.Fatalw("failed to open subscriptions", "file", env.Subscriptions, zap.Error(err))
+		}
+	} else if env.Examples {
+		subStore = background.NewSubscriptionStore(handler.ExampleSubscriptions()...)
+	} else {
+		subStore = background.NewSubscriptionStore()
+	}
+
+	subscriptionHandler := handler.NewSubscriptionHandler(subStore, subs)
+	// Resume delivery to the stored subscriptions, before serving changes to
+	// them. The vent is running, so this does not block on the channel.
+	subscriptionHandler.Resume()
 
 	r := mux.NewRouter()
+	r.Use(tracing.Middleware, logging.Middleware(logger.Named("http")), metrics.Middleware)
+
+	authn, err := authenticator(env)
+	if err != nil {
+		logger.Fatalw("failed to set up authentication", zap.Error(err))
+	}
+	if authn != nil {
+		r.Use(auth.Middleware(authn))
+	} else {
+		logger.Warn("authentication is disabled, every request may see and change everything")
+	}
 
 	r.Handle("/services", servicesHandler)
 	r.Handle("/services/{id}", servicesHandler)
 
+	r.Handle("/types", typesHandler)
+	r.Handle("/types/{type}", typesHandler)
+
 	r.Handle("/subscriptions", subscriptionHandler)
 	r.Handle("/subscriptions/{id}", subscriptionHandler)
 
 	http.Handle("/", r)
+	http.Handle("/metrics", metrics.Handler())
 
-	ctx := context.Background()
-
-	vent := background.NewVent(env.Service, env.Sinks, changes, subs)
-	go func() {
-		if err := vent.Start(ctx); err != nil {
-			log.Println(err)
+	downstreamOpts := make([]client.Option, 0)
+	if env.DownstreamToken != "" {
+		downstreamOpts = append(downstreamOpts, client.WithBearerToken(env.DownstreamToken))
+	}
+	switch env.Aggregation {
+	case "poll":
+		mgr.Start("aggregation", background.NewDiscoveryAggregation(env.Downstream, servicesHandler, logger.Named("aggregation"), downstreamOpts...))
+	case "push":
+		if authn != nil && env.PushToken == "" {
+			logger.Fatal("push aggregation with authentication requires DISCOVERY_PUSH_TOKEN")
 		}
-	}()
+		push := background.NewPushAggregation(env.Service, env.Downstream, env.PushToken, env.ResyncPeriod, servicesHandler, logger.Named("aggregation"), downstreamOpts...)
+		r.Handle(background.PushPath+"{token}", push)
+		mgr.Start("aggregation", push)
+	default:
+		logger.Fatalw("unknown aggregation mode, must be poll or push", "aggregation", env.Aggregation)
+	}
 
-	agg := background.NewDiscoveryAggregation(env.Downstream, servicesHandler)
-	go func() {
-		if err := agg.Start(ctx); err != nil {
-			log.Println(err)
+	addr := fmt.Sprintf(":%d", env.Port)
+	srv := &http.Server{Addr: addr}
+	if env.TLSCert != "" {
+		if srv.TLSConfig, err = auth.ServerTLSConfig(env.TLSCert, env.TLSKey, env.TLSClientCA); err != nil {
+			logger.Fatalw("failed to set up TLS", zap.Error(err))
 		}
-	}()
+	} else if env.TLSClientCA != "" {
+		logger.Fatal("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
 
-	addr := fmt.Sprintf(":%d", env.Port)
+	logger.Infow("will listen", "addr", addr, "tls", srv.TLSConfig != nil)
+	mgr.StartServer("http", srv)
 
-	log.Printf("will listen on %s\n", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal(err)
+	err = mgr.Wait(context.Background())
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Errorw("failed to flush traces", zap.Error(err))
+	}
+	if err != nil {
+		logger.Fatalw("shutdown", zap.Error(err))
 	}
 }
@@ -1,5 +1,7 @@
 package discovery
 
+import "encoding/json"
+
 type Service struct {
 	ID                 string            `json:"id"`                           // "id": "[a globally unique UUID]",
 	URL                string            `json:"url"`                          // "url": "[unique URL to this service]",
@@ -30,3 +32,36 @@ type ServiceTypeExtension struct {
 	Type    string `json:"type"`    // "type": "[CE type string]",
 	SpecURL string `json:"specurl"` // "specurl": "[URL to specification defining the extension]" ?
 }
+
+// UnmarshalJSON accepts the older "types" key as an alias for "events", the
+// example and testdata service files still use it.
+func (s *Service) UnmarshalJSON(b []byte) error {
+	type service Service
+	aux := struct {
+		*service
+		Types []ServiceEvent `json:"types,omitempty"`
+	}{service: (*service)(s)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if len(s.Events) == 0 && len(aux.Types) > 0 {
+		s.Events = aux.Types
+	}
+	return nil
+}
+
+// Type is an entry in the index of event types, it holds the services that
+// produce events of that type.
+type Type struct {
+	Type     string        `json:"type"`
+	Services []TypeService `json:"services"`
+}
+
+// TypeService references a service that produces a type, along with the
+// service's description of that event.
+type TypeService struct {
+	ID    string       `json:"id"`
+	URL   string       `json:"url"`
+	Name  string       `json:"name"`
+	Event ServiceEvent `json:"event"`
+}
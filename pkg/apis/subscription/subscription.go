@@ -40,6 +40,40 @@ type Subscription struct {
 	// for further details.
 	// +optional
 	Filter *Filter `json:"filter,omitempty"`
+
+	// Filters - An array of filter expressions that evaluates to true if all filter expressions evaluate to true,
+	// otherwise false. Filters are evaluated along with Filter, an event is delivered only if both match.
+	// +optional
+	Filters []FilterExpression `json:"filters,omitempty"`
+
+	// Tenant - The tenant of the principal that created the subscription, set by the subscription manager when
+	// authentication is enabled. Subscriptions are only visible to principals of the same tenant, and ids are unique
+	// within a tenant. Ignored in proposed subscriptions.
+	// +optional
+	Tenant string `json:"tenant,omitempty"`
+
+	// Owner - The principal that created the subscription, set by the subscription manager when authentication is
+	// enabled. It is reported so admins can tell whose subscriptions they manage. Ignored in proposed subscriptions.
+	// +optional
+	Owner string `json:"owner,omitempty"`
+
+	// OwnerScopes - The scopes the owner held when it last wrote the subscription. Events about services with an
+	// authscope the owner did not hold are not delivered. Internal to the subscription manager, it is never
+	// serialized and the subscription stores persist it themselves.
+	OwnerScopes []string `json:"-"`
+}
+
+// Key identifies the subscription across tenants.
+func (s *Subscription) Key() string {
+	return Key(s.Tenant, s.ID)
+}
+
+// Key identifies the subscription with the id in the tenant.
+func Key(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + "/" + id
 }
 
 type Protocol struct {
@@ -128,18 +162,63 @@ func (p *Protocol) MarshalJSON() ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-// TODO I think we do not need a custom unmarshal. Test this.
-//func (p *Protocol) UnmarshalJSON(b []byte) error {
-//	var ref string
-//	if err := json.Unmarshal(b, &ref); err != nil {
-//		return err
-//	}
-//	r := ParseURIRef(ref)
-//	if r != nil {
-//		*u = *r
-//	}
-//	return nil
-//}
+func (p *Protocol) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Protocol         string           `json:"protocol"`
+		ProtocolSettings *json.RawMessage `json:"protocolsettings,omitempty"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	ps, err := ParseProtocolSettings(raw.Protocol, raw.ProtocolSettings)
+	if err != nil {
+		return err
+	}
+	p.Protocol = raw.Protocol
+	p.ProtocolSettings = ps
+	return nil
+}
+
+// ParseProtocolSettings decodes raw into the settings type for protocol. Only
+// the settings for protocol are set on the result. Nil raw settings decode to
+// empty settings for protocol.
+func ParseProtocolSettings(protocol string, raw *json.RawMessage) (*ProtocolSettings, error) {
+	ps := &ProtocolSettings{Protocol: protocol}
+	var into interface{}
+	switch protocol {
+	case "AMQP":
+		ps.AMQPProtocol = new(AMQPProtocol)
+		into = ps.AMQPProtocol
+	case "MQTT3":
+		ps.MQTT3Protocol = new(MQTT3Protocol)
+		into = ps.MQTT3Protocol
+	case "MQTT5":
+		ps.MQTT5Protocol = new(MQTT5Protocol)
+		into = ps.MQTT5Protocol
+	case "HTTP":
+		ps.HTTPProtocol = new(HTTPProtocol)
+		into = ps.HTTPProtocol
+	case "KAFKA":
+		ps.KafkaProtocol = new(KafkaProtocol)
+		into = ps.KafkaProtocol
+	case "NATS":
+		ps.NATSProtocol = new(NATSProtocol)
+		into = ps.NATSProtocol
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %q", protocol)
+	}
+	if raw != nil && len(*raw) > 0 {
+		if err := json.Unmarshal(*raw, into); err != nil {
+			return nil, fmt.Errorf("invalid %s protocolsettings: %v", protocol, err)
+		}
+	}
+	return ps, nil
+}
+
+// Settings decodes the subscription's ProtocolSettings for its Protocol.
+func (s *Subscription) Settings() (*ProtocolSettings, error) {
+	return ParseProtocolSettings(s.Protocol, s.ProtocolSettings)
+}
 
 type HTTPProtocol struct {
 	// Headers - A set of key/value pairs that is copied into the HTTP request as custom headers.
@@ -147,6 +226,26 @@ type HTTPProtocol struct {
 
 	// Method - The HTTP method to use for sending the message. This defaults to POST if not set.
 	Method string `json:"method,omitempty"`
+
+	// Retry - Implementation specific. Controls redelivery of events that failed to be delivered. The server's
+	// delivery configuration is used for any field that is not set.
+	// +optional
+	Retry *RetryPolicy `json:"retry,omitempty"`
+}
+
+type RetryPolicy struct {
+	// MaxAttempts - The number of delivery attempts before an event is sent to the dead letter sink.
+	// +optional
+	MaxAttempts *int `json:"maxattempts,omitempty"`
+
+	// Backoff - The delay before the first retry as a duration string, e.g. "500ms". The delay doubles after each
+	// failed retry.
+	// +optional
+	Backoff string `json:"backoff,omitempty"`
+
+	// Timeout - The timeout for each delivery attempt as a positive duration string, e.g. "10s".
+	// +optional
+	Timeout string `json:"timeout,omitempty"`
 }
 
 type MQTT3Protocol struct {
@@ -231,8 +330,14 @@ type NATSProtocol struct {
 }
 
 type Filter struct {
-	Dialect string        `json:"dialect"` // only "basic" is supported
-	Filters []BasicFilter `json:"filters"`
+	Dialect string `json:"dialect"` // "basic", "cesql" or "jsonpath"
+
+	// Filters - The basic filters, all must match. Used by the "basic" dialect, and by the "jsonpath" dialect where
+	// each property is a JSONPath expression selecting values from the event data, e.g. "$.service.name".
+	Filters []BasicFilter `json:"filters,omitempty"`
+
+	// Expression - A CloudEvents SQL expression that must evaluate to true. Used by the "cesql" dialect.
+	Expression string `json:"expression,omitempty"`
 }
 
 // TODO: There could be other filters but they are currently not defined by the spec so we will do the easy way for now.
@@ -241,8 +346,100 @@ type BasicFilter struct {
 	Type string `json:"type"`
 
 	// The CloudEvents attribute (including extensions) to match the value indicated by the "value" property against.
+	// For the "jsonpath" dialect, a JSONPath expression into the event data; the filter matches if any selected value
+	// matches.
 	Property string `json:"property"`
 
 	// Value - The value to match the CloudEvents attribute against. This expression is a string and matches are executed against the string representation of the attribute value.
 	Value string `json:"value"`
 }
+
+// FilterExpression is a filter expression of the subscriptions API. Exactly one
+// of the fields is set.
+type FilterExpression struct {
+	// Exact - A single attribute name and the value its value must exactly match.
+	// +optional
+	Exact map[string]string `json:"exact,omitempty"`
+
+	// Prefix - A single attribute name and the value its value must start with.
+	// +optional
+	Prefix map[string]string `json:"prefix,omitempty"`
+
+	// Suffix - A single attribute name and the value its value must end with.
+	// +optional
+	Suffix map[string]string `json:"suffix,omitempty"`
+
+	// All - Nested filter expressions that all must evaluate to true.
+	// +optional
+	All []FilterExpression `json:"all,omitempty"`
+
+	// Any - Nested filter expressions of which at least one must evaluate to true.
+	// +optional
+	Any []FilterExpression `json:"any,omitempty"`
+
+	// Not - A nested filter expression that must evaluate to false.
+	// +optional
+	Not *FilterExpression `json:"not,omitempty"`
+
+	// SQL - A CloudEvents SQL expression that must evaluate to true.
+	// +optional
+	SQL string `json:"sql,omitempty"`
+}
+
+// active returns the settings for ps.Protocol.
+func (ps *ProtocolSettings) active() interface{} {
+	switch ps.Protocol {
+	case "AMQP":
+		return ps.AMQPProtocol
+	case "MQTT3":
+		return ps.MQTT3Protocol
+	case "MQTT5":
+		return ps.MQTT5Protocol
+	case "HTTP":
+		return ps.HTTPProtocol
+	case "KAFKA":
+		return ps.KafkaProtocol
+	case "NATS":
+		return ps.NATSProtocol
+	}
+	return nil
+}
+
+// SetDefaults realizes the subscription's protocol settings by applying the
+// default for every optional setting that is not set: the HTTP method is
+// POST, the MQTT QoS is 1 and the AMQP sender settlement mode is unsettled.
+func (s *Subscription) SetDefaults() error {
+	ps, err := s.Settings()
+	if err != nil {
+		return err
+	}
+
+	switch s.Protocol {
+	case "HTTP":
+		if ps.HTTPProtocol.Method == "" {
+			ps.HTTPProtocol.Method = "POST"
+		}
+	case "MQTT3":
+		if ps.MQTT3Protocol.QOS == nil {
+			qos := 1
+			ps.MQTT3Protocol.QOS = &qos
+		}
+	case "MQTT5":
+		if ps.MQTT5Protocol.QOS == nil {
+			qos := 1
+			ps.MQTT5Protocol.QOS = &qos
+		}
+	case "AMQP":
+		if ps.AMQPProtocol.SenderSettlementMode == "" {
+			ps.AMQPProtocol.SenderSettlementMode = "unsettled"
+		}
+	}
+
+	b, err := json.Marshal(ps.active())
+	if err != nil {
+		return err
+	}
+	raw := json.RawMessage(b)
+	s.ProtocolSettings = &raw
+	return nil
+}
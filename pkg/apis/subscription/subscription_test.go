@@ -0,0 +1,45 @@
+package subscription
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSetDefaults(t *testing.T) {
+	tests := map[string]struct {
+		protocol string
+		settings string
+		want     string
+	}{
+		"http":             {protocol: "HTTP", want: `{"method":"POST"}`},
+		"http method":      {protocol: "HTTP", settings: `{"method":"PUT"}`, want: `{"method":"PUT"}`},
+		"mqtt3":            {protocol: "MQTT3", settings: `{"topicname":"t"}`, want: `{"topicname":"t","qos":1,"retain":false}`},
+		"mqtt3 qos 0":      {protocol: "MQTT3", settings: `{"topicname":"t","qos":0}`, want: `{"topicname":"t","qos":0,"retain":false}`},
+		"mqtt5":            {protocol: "MQTT5", want: `{"topicname":"","qos":1,"retain":false}`},
+		"amqp":             {protocol: "AMQP", want: `{"sendersettlementmode":"unsettled","linkproperties":null}`},
+		"amqp settled":     {protocol: "AMQP", settings: `{"sendersettlementmode":"settled"}`, want: `{"sendersettlementmode":"settled","linkproperties":null}`},
+		"kafka no default": {protocol: "KAFKA", settings: `{"topicname":"t"}`, want: `{"topicname":"t"}`},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := Subscription{Protocol: tc.protocol}
+			if tc.settings != "" {
+				raw := json.RawMessage(tc.settings)
+				s.ProtocolSettings = &raw
+			}
+			if err := s.SetDefaults(); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(*s.ProtocolSettings); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+			// Realizing is idempotent.
+			if err := s.SetDefaults(); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(*s.ProtocolSettings); got != tc.want {
+				t.Errorf("realized again to %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
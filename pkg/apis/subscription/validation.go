@@ -0,0 +1,277 @@
+package subscription
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/cesql"
+	"github.com/n3wscott/cloudevents-discovery/pkg/jsonpath"
+)
+
+// FieldError describes a single invalid field of a subscription.
+type FieldError struct {
+	// Field - The path to the invalid field, e.g. "protocolsettings.qos".
+	Field string `json:"field"`
+	// Message - A human readable description of the problem.
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError is returned by Validate for a subscription with invalid
+// fields. It maps to the spec's "invalid" error.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Error())
+	}
+	return "invalid subscription: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Protocols are the supported delivery protocol identifiers.
+var Protocols = []string{"AMQP", "MQTT3", "MQTT5", "HTTP", "KAFKA", "NATS"}
+
+// sinkSchemes are the sink URI schemes accepted for each protocol, including
+// the protocol's own transport bindings.
+var sinkSchemes = map[string][]string{
+	"AMQP":  {"amqp", "amqps"},
+	"MQTT3": {"mqtt", "mqtts", "tcp", "ssl", "tls", "ws", "wss"},
+	"MQTT5": {"mqtt", "mqtts", "tcp", "ssl", "tls", "ws", "wss"},
+	"HTTP":  {"http", "https"},
+	"KAFKA": {"kafka", "kafka+ssl"},
+	"NATS":  {"nats", "tls"},
+}
+
+// FilterDialects are the supported filter dialects.
+var FilterDialects = []string{"basic", "cesql", "jsonpath"}
+
+// BasicFilterTypes are the supported basic filter types.
+var BasicFilterTypes = []string{"prefix", "suffix", "exact"}
+
+// Validate checks the subscription has all required fields, a supported
+// protocol, a sink valid for that protocol, protocol settings that decode
+// for that protocol and a supported filter. Returns a *ValidationError
+// listing every problem found.
+func (s *Subscription) Validate() error {
+	verr := new(ValidationError)
+
+	if s.ID == "" {
+		verr.add("id", "required")
+	}
+
+	if s.Protocol == "" {
+		verr.add("protocol", "required")
+	} else if !contains(Protocols, s.Protocol) {
+		verr.add("protocol", "unsupported protocol %q, must be one of %s", s.Protocol, strings.Join(Protocols, ", "))
+	}
+
+	if s.Sink.String() == "" {
+		verr.add("sink", "required")
+	} else if !s.Sink.IsAbs() || s.Sink.Host == "" {
+		verr.add("sink", "must be an absolute URI with a host, got %q", s.Sink.String())
+	} else if schemes, ok := sinkSchemes[s.Protocol]; ok && !contains(schemes, strings.ToLower(s.Sink.Scheme)) {
+		verr.add("sink", "scheme %q is not valid for protocol %s, must be one of %s", s.Sink.Scheme, s.Protocol, strings.Join(schemes, ", "))
+	}
+
+	if contains(Protocols, s.Protocol) {
+		if ps, err := s.Settings(); err != nil {
+			verr.add("protocolsettings", "%v", err)
+		} else {
+			validateSettings(verr, s, ps)
+		}
+	}
+
+	if s.Filter != nil {
+		validateFilter(verr, s.Filter)
+	}
+	for i, fe := range s.Filters {
+		validateFilterExpression(verr, fmt.Sprintf("filters[%d]", i), &fe)
+	}
+
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func validateSettings(verr *ValidationError, s *Subscription, ps *ProtocolSettings) {
+	const field = "protocolsettings"
+	switch s.Protocol {
+	case "HTTP":
+		if m := ps.HTTPProtocol.Method; m != "" && strings.ContainsAny(m, " \t\r\n") {
+			verr.add(field+".method", "invalid HTTP method %q", m)
+		}
+		for k := range ps.HTTPProtocol.Headers {
+			if strings.TrimSpace(k) == "" {
+				verr.add(field+".headers", "header names must not be empty")
+			}
+		}
+		if r := ps.HTTPProtocol.Retry; r != nil {
+			if r.MaxAttempts != nil && *r.MaxAttempts < 1 {
+				verr.add(field+".retry.maxattempts", "must be at least 1")
+			}
+			validateDuration(verr, field+".retry.backoff", r.Backoff)
+			validateDuration(verr, field+".retry.timeout", r.Timeout)
+			if d, err := time.ParseDuration(r.Timeout); err == nil && d == 0 {
+				verr.add(field+".retry.timeout", "must be positive")
+			}
+		}
+
+	case "MQTT3":
+		validateMQTT(verr, s, ps.MQTT3Protocol.TopicName, ps.MQTT3Protocol.QOS)
+
+	case "MQTT5":
+		validateMQTT(verr, s, ps.MQTT5Protocol.TopicName, ps.MQTT5Protocol.QOS)
+		if e := ps.MQTT5Protocol.Expiry; e != nil && *e < 0 {
+			verr.add(field+".expiry", "must not be negative")
+		}
+
+	case "AMQP":
+		switch strings.ToLower(ps.AMQPProtocol.SenderSettlementMode) {
+		case "", "settled", "unsettled":
+		default:
+			verr.add(field+".sendersettlementmode", "must be settled or unsettled, got %q", ps.AMQPProtocol.SenderSettlementMode)
+		}
+		if ps.AMQPProtocol.Address == "" && strings.Trim(s.Sink.Path, "/") == "" {
+			verr.add(field+".address", "required when the sink has no path")
+		}
+
+	case "KAFKA":
+		switch strings.ToLower(ps.KafkaProtocol.ACKs) {
+		case "", "0", "1", "-1", "all", "none", "leader":
+		default:
+			verr.add(field+".acks", "must be one of 0, 1 or all, got %q", ps.KafkaProtocol.ACKs)
+		}
+		if ps.KafkaProtocol.TopicName == "" && strings.Trim(s.Sink.Path, "/") == "" {
+			verr.add(field+".topicname", "required when the sink has no path")
+		}
+
+	case "NATS":
+		if ps.NATSProtocol.Subject == "" && strings.Trim(s.Sink.Path, "/") == "" {
+			verr.add(field+".subject", "required when the sink has no path")
+		}
+	}
+}
+
+func validateMQTT(verr *ValidationError, s *Subscription, topic string, qos *int) {
+	if topic == "" && strings.Trim(s.Sink.Path, "/") == "" {
+		verr.add("protocolsettings.topicname", "required when the sink has no path")
+	}
+	if qos != nil && (*qos < 0 || *qos > 2) {
+		verr.add("protocolsettings.qos", "must be 0, 1 or 2, got %d", *qos)
+	}
+}
+
+func validateDuration(verr *ValidationError, field, d string) {
+	if d == "" {
+		return
+	}
+	if v, err := time.ParseDuration(d); err != nil {
+		verr.add(field, "%v", err)
+	} else if v < 0 {
+		verr.add(field, "must not be negative")
+	}
+}
+
+func validateFilter(verr *ValidationError, f *Filter) {
+	if !contains(FilterDialects, f.Dialect) {
+		verr.add("filter.dialect", "unsupported filter dialect %q, must be one of %s", f.Dialect, strings.Join(FilterDialects, ", "))
+		return
+	}
+	if f.Dialect == "cesql" {
+		if f.Expression == "" {
+			verr.add("filter.expression", "required")
+		} else if _, err := cesql.Parse(f.Expression); err != nil {
+			verr.add("filter.expression", "%v", err)
+		}
+		return
+	}
+	for i, bf := range f.Filters {
+		field := fmt.Sprintf("filter.filters[%d]", i)
+		if !contains(BasicFilterTypes, bf.Type) {
+			verr.add(field+".type", "unsupported filter type %q, must be one of %s", bf.Type, strings.Join(BasicFilterTypes, ", "))
+		}
+		if bf.Property == "" {
+			verr.add(field+".property", "required")
+		} else if f.Dialect == "jsonpath" {
+			if _, err := jsonpath.Parse(bf.Property); err != nil {
+				verr.add(field+".property", "%v", err)
+			}
+		}
+	}
+}
+
+// validateFilterExpression checks exactly one operator is set, attribute
+// filters name a single attribute and nested filters are valid.
+func validateFilterExpression(verr *ValidationError, field string, fe *FilterExpression) {
+	set := make([]string, 0, 1)
+	for op, ok := range map[string]bool{
+		"exact":  fe.Exact != nil,
+		"prefix": fe.Prefix != nil,
+		"suffix": fe.Suffix != nil,
+		"all":    fe.All != nil,
+		"any":    fe.Any != nil,
+		"not":    fe.Not != nil,
+		"sql":    fe.SQL != "",
+	} {
+		if ok {
+			set = append(set, op)
+		}
+	}
+	if len(set) != 1 {
+		sort.Strings(set)
+		verr.add(field, "must set exactly one of exact, prefix, suffix, all, any, not or sql, got %d %v", len(set), set)
+		return
+	}
+
+	switch op := set[0]; op {
+	case "exact", "prefix", "suffix":
+		attrs := map[string]map[string]string{"exact": fe.Exact, "prefix": fe.Prefix, "suffix": fe.Suffix}[op]
+		if len(attrs) != 1 {
+			verr.add(field+"."+op, "must name exactly one attribute, got %d", len(attrs))
+		}
+		for name := range attrs {
+			if name == "" {
+				verr.add(field+"."+op, "attribute name required")
+			}
+		}
+	case "all", "any":
+		list := fe.All
+		if op == "any" {
+			list = fe.Any
+		}
+		if len(list) == 0 {
+			verr.add(field+"."+op, "must have at least one filter expression")
+		}
+		for i := range list {
+			validateFilterExpression(verr, fmt.Sprintf("%s.%s[%d]", field, op, i), &list[i])
+		}
+	case "not":
+		validateFilterExpression(verr, field+".not", fe.Not)
+	case "sql":
+		if _, err := cesql.Parse(fe.SQL); err != nil {
+			verr.add(field+".sql", "%v", err)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
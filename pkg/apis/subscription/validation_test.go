@@ -0,0 +1,107 @@
+package subscription
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cloudevents/sdk-go/v2/types"
+)
+
+func TestValidateAMQPSinkScheme(t *testing.T) {
+	for sink, valid := range map[string]bool{
+		"amqp://broker/services":     true,
+		"amqps://broker/services":    true,
+		"AMQPS://broker/services":    true,
+		"amqp+ws://broker/services":  false,
+		"amqp+wss://broker/services": false,
+		"http://broker/services":     false,
+	} {
+		s := Subscription{ID: "sub", Protocol: "AMQP", Sink: *types.ParseURI(sink)}
+		if err := s.Validate(); (err == nil) != valid {
+			t.Errorf("sink %s: got %v, want valid %t", sink, err, valid)
+		}
+	}
+}
+
+func TestValidateRetryTimeout(t *testing.T) {
+	for timeout, valid := range map[string]bool{
+		"":     true,
+		"10s":  true,
+		"0s":   false,
+		"0":    false,
+		"-1s":  false,
+		"soon": false,
+	} {
+		raw := json.RawMessage(fmt.Sprintf(`{"retry":{"timeout":%q}}`, timeout))
+		s := Subscription{ID: "sub", Protocol: "HTTP", Sink: *types.ParseURI("http://sink"), ProtocolSettings: &raw}
+		if err := s.Validate(); (err == nil) != valid {
+			t.Errorf("timeout %q: got %v, want valid %t", timeout, err, valid)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		sub  string
+		want []string
+	}{
+		"valid http":            {sub: `{"id":"s","protocol":"HTTP","sink":"https://sink.test/events"}`},
+		"valid mqtt":            {sub: `{"id":"s","protocol":"MQTT5","sink":"mqtt://broker.test","protocolsettings":{"topicname":"events","qos":2,"expiry":10}}`},
+		"valid kafka":           {sub: `{"id":"s","protocol":"KAFKA","sink":"kafka+ssl://broker.test/services","protocolsettings":{"acks":"all"}}`},
+		"valid nats":            {sub: `{"id":"s","protocol":"NATS","sink":"nats://nats.test","protocolsettings":{"subject":"services"}}`},
+		"empty":                 {sub: `{}`, want: []string{"id", "protocol", "sink"}},
+		"unknown protocol":      {sub: `{"id":"s","protocol":"http","sink":"http://sink.test"}`, want: []string{"protocol"}},
+		"relative sink":         {sub: `{"id":"s","protocol":"HTTP","sink":"/events"}`, want: []string{"sink"}},
+		"sink scheme":           {sub: `{"id":"s","protocol":"HTTP","sink":"kafka://broker.test/topic"}`, want: []string{"sink"}},
+		"undecodable":           {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","protocolsettings":{"method":5}}`, want: []string{"protocolsettings"}},
+		"http method":           {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","protocolsettings":{"method":"GET ME"}}`, want: []string{"protocolsettings.method"}},
+		"http header":           {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","protocolsettings":{"headers":{" ":"x"}}}`, want: []string{"protocolsettings.headers"}},
+		"retry":                 {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","protocolsettings":{"retry":{"maxattempts":0,"backoff":"-1s"}}}`, want: []string{"protocolsettings.retry.backoff", "protocolsettings.retry.maxattempts"}},
+		"mqtt topic and qos":    {sub: `{"id":"s","protocol":"MQTT3","sink":"mqtt://broker.test","protocolsettings":{"qos":3}}`, want: []string{"protocolsettings.qos", "protocolsettings.topicname"}},
+		"mqtt topic in path":    {sub: `{"id":"s","protocol":"MQTT3","sink":"mqtt://broker.test/events"}`},
+		"mqtt expiry":           {sub: `{"id":"s","protocol":"MQTT5","sink":"mqtt://broker.test/events","protocolsettings":{"expiry":-1}}`, want: []string{"protocolsettings.expiry"}},
+		"amqp":                  {sub: `{"id":"s","protocol":"AMQP","sink":"amqp://broker.test","protocolsettings":{"sendersettlementmode":"maybe"}}`, want: []string{"protocolsettings.address", "protocolsettings.sendersettlementmode"}},
+		"kafka":                 {sub: `{"id":"s","protocol":"KAFKA","sink":"kafka://broker.test","protocolsettings":{"acks":"2"}}`, want: []string{"protocolsettings.acks", "protocolsettings.topicname"}},
+		"nats":                  {sub: `{"id":"s","protocol":"NATS","sink":"nats://nats.test"}`, want: []string{"protocolsettings.subject"}},
+		"filter dialect":        {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filter":{"dialect":"regex"}}`, want: []string{"filter.dialect"}},
+		"basic filter":          {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filter":{"dialect":"basic","filters":[{"type":"prefix","property":"type","value":"a"},{"type":"glob"}]}}`, want: []string{"filter.filters[1].property", "filter.filters[1].type"}},
+		"jsonpath filter":       {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filter":{"dialect":"jsonpath","filters":[{"type":"exact","property":"$.[","value":"a"}]}}`, want: []string{"filter.filters[0].property"}},
+		"cesql filter":          {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filter":{"dialect":"cesql","expression":"type ="}}`, want: []string{"filter.expression"}},
+		"empty cesql":           {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filter":{"dialect":"cesql"}}`, want: []string{"filter.expression"}},
+		"filters":               {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filters":[{"exact":{"type":"a"}},{"any":[{"not":{"sql":"id = '1'"}}]}]}`},
+		"filters no operator":   {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filters":[{}]}`, want: []string{"filters[0]"}},
+		"filters two operators": {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filters":[{"exact":{"type":"a"},"sql":"TRUE"}]}`, want: []string{"filters[0]"}},
+		"filters attributes":    {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filters":[{"prefix":{"type":"a","id":"b"}},{"suffix":{"":"a"}}]}`, want: []string{"filters[0].prefix", "filters[1].suffix"}},
+		"filters nested":        {sub: `{"id":"s","protocol":"HTTP","sink":"http://sink.test","filters":[{"all":[{"exact":{"id":"1"}},{"not":{"sql":"("}}]},{"any":[]}]}`, want: []string{"filters[0].all[1].not.sql", "filters[1].any"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var s Subscription
+			if err := json.Unmarshal([]byte(tc.sub), &s); err != nil {
+				t.Fatal(err)
+			}
+			err := s.Validate()
+			if len(tc.want) == 0 {
+				if err != nil {
+					t.Fatalf("got %v, want valid", err)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("got %v, want a *ValidationError", err)
+			}
+			got := make([]string, 0, len(verr.Errors))
+			for _, fe := range verr.Errors {
+				got = append(got, fe.Field)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got invalid fields %v, want %v: %v", got, tc.want, err)
+			}
+		})
+	}
+}
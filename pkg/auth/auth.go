@@ -0,0 +1,146 @@
+// Package auth authenticates requests with static bearer tokens, JWTs signed
+// by keys in a local JWKS file or TLS client certificates, and authorizes
+// them: services are visible to principals holding their authscope and
+// subscriptions to the principal that owns them, within its tenant.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// AdminScope grants a principal every scope and ownership of every
+// subscription of its tenant.
+const AdminScope = "cloudmeta.admin"
+
+// ErrNoCredentials is returned by an Authenticator when the request does not
+// carry the kind of credentials it checks.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Principal is the authenticated party making a request.
+type Principal struct {
+	// Name identifies the principal, it is recorded as the owner of the
+	// subscriptions it creates.
+	Name string
+	// Scopes are the authscopes of the services the principal may see.
+	Scopes []string
+	// Tenant isolates the subscriptions of its principals from other
+	// tenants. A principal without a tenant is a tenant of its own, see
+	// PersonalTenant.
+	Tenant string
+}
+
+// PersonalTenant is the tenant of the named principal when it has none. It
+// is namespaced, so a principal can not share a tenant by being named after
+// it.
+func PersonalTenant(name string) string {
+	return "user:" + name
+}
+
+// HasScope returns true if the principal holds the scope or AdminScope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == AdminScope {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSee returns true if the principal may see a service with the authscope.
+// Services without an authscope are visible to everyone. A nil principal,
+// from a server without authentication, sees everything.
+func (p *Principal) CanSee(authScope string) bool {
+	return p == nil || authScope == "" || p.HasScope(authScope)
+}
+
+// Owns returns true if the principal may manage a subscription with the
+// owner. A nil principal, from a server without authentication, owns
+// everything.
+func (p *Principal) Owns(owner string) bool {
+	return p == nil || p.Name == owner || p.HasScope(AdminScope)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the context's principal, nil if the request was not
+// authenticated because authentication is disabled.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Tenant returns the tenant of the context's principal, empty if
+// authentication is disabled.
+func Tenant(ctx context.Context) string {
+	if p := FromContext(ctx); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+// Authenticator returns the principal for the credentials on a request. It
+// returns ErrNoCredentials if the request has none it understands, and any
+// other error if it has credentials that are not valid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Chain tries each authenticator in order and returns the first principal
+// found. A bearer token may be a static token or a JWT, so a rejection does
+// not stop the chain, every rejection is returned if none succeed.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	rejected := make([]string, 0)
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if err == nil {
+			return p, nil
+		}
+		if err != ErrNoCredentials {
+			rejected = append(rejected, err.Error())
+		}
+	}
+	if len(rejected) > 0 {
+		return nil, errors.New(strings.Join(rejected, "; "))
+	}
+	return nil, ErrNoCredentials
+}
+
+// Middleware rejects requests that authn cannot authenticate with 401 and
+// puts the principal in the request context for handlers to get with
+// FromContext.
+func Middleware(authn Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := authn.Authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="cloudmeta"`)
+				http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if p.Tenant == "" {
+				p.Tenant = PersonalTenant(p.Name)
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return h[len(prefix):], true
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareTenant(t *testing.T) {
+	tokens := Tokens{
+		{Token: "acme-token", Name: "alice", Tenant: "acme"},
+		{Token: "named-token", Name: "acme"},
+	}
+	tests := map[string]string{
+		"acme-token":  "acme",
+		"named-token": "user:acme",
+	}
+	for token, want := range tests {
+		var got string
+		h := Middleware(tokens)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			got = Tenant(r.Context())
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/subscriptions", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != want {
+			t.Errorf("%s: got tenant %q, want %q", token, got, want)
+		}
+	}
+}
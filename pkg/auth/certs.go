@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ClientCerts authenticates requests by their verified TLS client
+// certificate. The principal is named by the certificate's subject common
+// name, holds its organizational units as scopes and belongs to its first
+// organization.
+type ClientCerts struct{}
+
+func (ClientCerts) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, fmt.Errorf("client certificate has no common name")
+	}
+	p := &Principal{
+		Name:   cert.Subject.CommonName,
+		Scopes: cert.Subject.OrganizationalUnit,
+	}
+	if len(cert.Subject.Organization) > 0 {
+		p.Tenant = cert.Subject.Organization[0]
+	}
+	return p, nil
+}
+
+// ServerTLSConfig returns the TLS config for a server with the certificate
+// and key. If clientCAFile is set, client certificates signed by those CAs
+// are verified when presented, for ClientCerts to authenticate.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		// Requests without a certificate may still authenticate with a token.
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Token is an entry in a static tokens file.
+type Token struct {
+	Token  string   `json:"token"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+}
+
+// Tokens authenticates requests bearing one of a fixed set of tokens.
+type Tokens []Token
+
+// LoadTokens reads a JSON array of Token from file.
+func LoadTokens(file string) (Tokens, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(Tokens, 0)
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for i, t := range tokens {
+		if t.Token == "" || t.Name == "" {
+			return nil, fmt.Errorf("%s: token %d: token and name are required", file, i)
+		}
+	}
+	return tokens, nil
+}
+
+func (t Tokens) Authenticate(r *http.Request) (*Principal, error) {
+	bearer, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	var found *Token
+	for i := range t {
+		// Compare every token so the time taken does not reveal which matched.
+		if subtle.ConstantTimeCompare([]byte(t[i].Token), []byte(bearer)) == 1 {
+			found = &t[i]
+		}
+	}
+	if found == nil {
+		return nil, errors.New("unknown bearer token")
+	}
+	return &Principal{Name: found.Name, Scopes: found.Scopes, Tenant: found.Tenant}, nil
+}
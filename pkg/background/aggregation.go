@@ -2,21 +2,33 @@ package background
 
 import (
 	"context"
-	"fmt"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
 	"github.com/n3wscott/cloudevents-discovery/pkg/client"
+	"github.com/n3wscott/cloudevents-discovery/pkg/metrics"
+	"github.com/n3wscott/cloudevents-discovery/pkg/tracing"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 type discoveryAggregation struct {
 	downstream []url.URL
 	period     time.Duration
 	mgr        ServicesManager
+	logger     *zap.SugaredLogger
+	// opts hold the credentials for the downstreams.
+	opts []client.Option
 }
 
-// downstream is a comma separated list of urls.
-func NewDiscoveryAggregation(downstream string, mgr ServicesManager) Background {
+// downstream is a comma separated list of urls. opts configure the client
+// for the downstreams, with credentials if they require authentication.
+func NewDiscoveryAggregation(downstream string, mgr ServicesManager, logger *zap.SugaredLogger, opts ...client.Option) Background {
 	ds := make([]url.URL, 0)
 	for _, s := range strings.Split(downstream, ",") {
 		s = strings.TrimSpace(s)
@@ -33,33 +45,56 @@ func NewDiscoveryAggregation(downstream string, mgr ServicesManager) Background
 		downstream: ds,
 		period:     time.Second * 10,
 		mgr:        mgr,
+		logger:     logger,
+		opts:       opts,
 	}
 }
 
 func (a *discoveryAggregation) Start(ctx context.Context) error {
-	c := client.New()
+	opts := append([]client.Option{client.WithHTTPClient(&http.Client{Transport: tracing.Transport(http.DefaultTransport)})}, a.opts...)
+	c := client.New(opts...)
 	timer := time.Tick(a.period)
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println("Discovery Aggregation - done")
+			a.logger.Info("discovery aggregation done")
 			return ctx.Err()
 		case <-timer:
-			fmt.Printf("Discovery.Services[%d]\n", len(a.downstream))
-
 			for _, d := range a.downstream {
-				fmt.Printf("\tfor %s,\n", d.String())
-				svcs, err := c.Discovery(d).Services().List(ctx, nil)
-				if err != nil {
-					fmt.Printf("\tfailed to list services from %s, %v", d.String(), err)
-					continue
-				}
-				for i, svc := range svcs {
-
-					fmt.Printf("\t[%d]:\t%+v\n", i, svc)
-					a.mgr.Set(svc)
-				}
+				a.pull(ctx, c, d, a.set)
 			}
 		}
 	}
 }
+
+// pull lists the services of the downstream and applies them, traced so the
+// changes apply makes continue the trace.
+func (a *discoveryAggregation) pull(ctx context.Context, c client.Client, d url.URL, apply func(context.Context, []discovery.Service)) error {
+	ctx, span := tracing.Tracer().Start(ctx, "aggregation.pull", trace.WithAttributes(
+		attribute.String("cloudmeta.downstream", d.String()),
+	))
+	defer span.End()
+
+	logger := a.logger.With("downstream", d.String())
+	start := time.Now()
+	svcs, err := c.Discovery(d).Services().List(ctx, nil)
+	metrics.AggregationPullDuration.WithLabelValues(d.String()).Observe(time.Since(start).Seconds())
+	metrics.AggregationPulls.WithLabelValues(d.String(), metrics.Result(err)).Inc()
+	if err != nil {
+		logger.Warnw("failed to list services", zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	logger.Debugw("listed services", "count", len(svcs))
+	apply(ctx, svcs)
+	return nil
+}
+
+// set sets every listed service.
+func (a *discoveryAggregation) set(ctx context.Context, svcs []discovery.Service) {
+	for _, svc := range svcs {
+		a.logger.Debugw("aggregating service", "service", svc.ID, "epoch", svc.Epoch)
+		a.mgr.Set(ctx, svc)
+	}
+}
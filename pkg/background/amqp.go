@@ -0,0 +1,199 @@
+package background
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-amqp"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/spec"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// Based on https://github.com/cloudevents/spec/blob/v1.0/amqp-protocol-binding.md
+
+const amqpPropertyPrefix = "cloudEvents:"
+
+// amqpMessage is a CloudEvent written in binary mode for the AMQP binding.
+type amqpMessage struct {
+	amqp.Message
+}
+
+var _ binding.BinaryWriter = (*amqpMessage)(nil)
+
+func (m *amqpMessage) Start(_ context.Context) error {
+	m.Properties = new(amqp.MessageProperties)
+	m.ApplicationProperties = make(map[string]interface{})
+	return nil
+}
+
+func (m *amqpMessage) SetAttribute(attribute spec.Attribute, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	s, err := types.Format(value)
+	if err != nil {
+		return err
+	}
+	if attribute.Kind() == spec.DataContentType {
+		m.Properties.ContentType = &s
+		return nil
+	}
+	m.ApplicationProperties[amqpPropertyPrefix+attribute.Name()] = s
+	return nil
+}
+
+func (m *amqpMessage) SetExtension(name string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	s, err := types.Format(value)
+	if err != nil {
+		return err
+	}
+	m.ApplicationProperties[amqpPropertyPrefix+name] = s
+	return nil
+}
+
+func (m *amqpMessage) SetData(data io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, data); err != nil {
+		return err
+	}
+	m.Data = [][]byte{buf.Bytes()}
+	return nil
+}
+
+func (m *amqpMessage) End(_ context.Context) error {
+	return nil
+}
+
+// amqpSettlementMode maps the SenderSettlementMode protocol setting.
+func amqpSettlementMode(mode string) (*amqp.SenderSettleMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "unsettled":
+		return amqp.SenderSettleModeUnsettled.Ptr(), nil
+	case "settled":
+		return amqp.SenderSettleModeSettled.Ptr(), nil
+	default:
+		return nil, fmt.Errorf("unsupported amqp sendersettlementmode %q, must be settled or unsettled", mode)
+	}
+}
+
+// amqpSender sends binary mode CloudEvents over an AMQP 1.0 link.
+type amqpSender struct {
+	addr        string
+	credentials bool
+	target      string
+	options     amqp.SenderOptions
+
+	mu     sync.Mutex
+	conn   *amqp.Conn
+	sender *amqp.Sender
+}
+
+func newAMQPSender(sink types.URI, settings *subscription.AMQPProtocol) (*amqpSender, error) {
+	if settings == nil {
+		settings = new(subscription.AMQPProtocol)
+	}
+	mode, err := amqpSettlementMode(settings.SenderSettlementMode)
+	if err != nil {
+		return nil, err
+	}
+
+	server := sink.URL
+	target := settings.Address
+	if target == "" {
+		target = strings.TrimPrefix(server.Path, "/")
+	}
+	server.Path = ""
+
+	options := amqp.SenderOptions{
+		Name:           settings.LinkName,
+		SettlementMode: mode,
+	}
+	if len(settings.LinkProperties) > 0 {
+		options.Properties = make(map[string]interface{}, len(settings.LinkProperties))
+		for k, v := range settings.LinkProperties {
+			options.Properties[k] = v
+		}
+	}
+
+	return &amqpSender{
+		addr:        server.String(),
+		credentials: server.User != nil,
+		target:      target,
+		options:     options,
+	}, nil
+}
+
+// connect lazily opens the connection and the send link, and reopens them
+// after a failure.
+func (s *amqpSender) connect(ctx context.Context) (*amqp.Sender, error) {
+	if s.sender != nil {
+		return s.sender, nil
+	}
+	// Credentials in the sink url are used for SASL PLAIN.
+	opts := &amqp.ConnOptions{}
+	if !s.credentials {
+		opts.SASLType = amqp.SASLTypeAnonymous()
+	}
+	conn, err := amqp.Dial(ctx, s.addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sender, err := session.NewSender(ctx, s.target, &s.options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn, s.sender = conn, sender
+	return sender, nil
+}
+
+func (s *amqpSender) Send(ctx context.Context, m binding.Message, transformers ...binding.Transformer) (err error) {
+	defer func() { _ = m.Finish(err) }()
+
+	msg := new(amqpMessage)
+	if _, err = binding.Write(ctx, m, nil, msg, transformers...); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sender, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	// With unsettled links Send waits for the receiver's disposition.
+	if err = sender.Send(ctx, &msg.Message, nil); err != nil {
+		s.close()
+	}
+	return err
+}
+
+func (s *amqpSender) Close(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close()
+}
+
+// close must be called with s.mu held.
+func (s *amqpSender) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.sender = nil, nil
+	return err
+}
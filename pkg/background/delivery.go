@@ -0,0 +1,304 @@
+package background
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/metrics"
+	"github.com/n3wscott/cloudevents-discovery/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// DeliveryConfig holds the server wide delivery settings. Subscriptions may
+// override the retry settings in their protocol settings.
+type DeliveryConfig struct {
+	// MaxAttempts is the number of attempts before an event is dead-lettered.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each retry.
+	Backoff time.Duration
+	// Timeout bounds each delivery attempt.
+	Timeout time.Duration
+	// QueueSize is the number of events buffered per sink. Events that do
+	// not fit are dead-lettered.
+	QueueSize int
+	// DeadLetterSink is an HTTP url that receives events that could not be
+	// delivered. Undeliverable events are dropped if unset.
+	DeadLetterSink string
+	// DrainTimeout bounds delivering the queued events when the vent stops,
+	// deliveries still in progress after it are cancelled.
+	DrainTimeout time.Duration
+}
+
+// DefaultDeliveryConfig is used by NewVent for any unset field.
+var DefaultDeliveryConfig = DeliveryConfig{
+	MaxAttempts:  3,
+	Backoff:      time.Second,
+	Timeout:      10 * time.Second,
+	QueueSize:    100,
+	DrainTimeout: 10 * time.Second,
+}
+
+func (c DeliveryConfig) withDefaults() DeliveryConfig {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultDeliveryConfig.MaxAttempts
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = DefaultDeliveryConfig.Backoff
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultDeliveryConfig.Timeout
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = DefaultDeliveryConfig.QueueSize
+	}
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = DefaultDeliveryConfig.DrainTimeout
+	}
+	return c
+}
+
+// retryPolicy is the resolved retry policy for a single sink.
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	timeout     time.Duration
+}
+
+// retryFor resolves the subscription's retry policy over the server defaults.
+func (c DeliveryConfig) retryFor(p *subscription.RetryPolicy) (retryPolicy, error) {
+	r := retryPolicy{
+		maxAttempts: c.MaxAttempts,
+		backoff:     c.Backoff,
+		timeout:     c.Timeout,
+	}
+	if p == nil {
+		return r, nil
+	}
+	if p.MaxAttempts != nil {
+		if *p.MaxAttempts < 1 {
+			return r, fmt.Errorf("retry maxattempts must be at least 1, got %d", *p.MaxAttempts)
+		}
+		r.maxAttempts = *p.MaxAttempts
+	}
+	if p.Backoff != "" {
+		d, err := time.ParseDuration(p.Backoff)
+		if err != nil {
+			return r, fmt.Errorf("retry backoff: %v", err)
+		}
+		r.backoff = d
+	}
+	if p.Timeout != "" {
+		d, err := time.ParseDuration(p.Timeout)
+		if err != nil {
+			return r, fmt.Errorf("retry timeout: %v", err)
+		}
+		if d <= 0 {
+			return r, fmt.Errorf("retry timeout must be positive, got %s", p.Timeout)
+		}
+		r.timeout = d
+	}
+	return r, nil
+}
+
+// deadLetter sends events that exhausted their retries, or did not fit a
+// sink's queue, to the dead letter sink. Events are queued and sent by run so
+// a slow dead letter sink does not hold up the vent or the sinks.
+type deadLetter struct {
+	// client sends to the dead letter sink, nil if there is none and
+	// undeliverable events are dropped.
+	client  cloudevents.Client
+	target  string
+	timeout time.Duration
+	queue   chan deadLetterEvent
+	done    chan struct{}
+}
+
+type deadLetterEvent struct {
+	sk     *sink
+	event  cloudevents.Event
+	reason error
+}
+
+// newDeadLetter sends to the target, queueing up to size events and bounding
+// each send by timeout.
+func newDeadLetter(target string, timeout time.Duration, size int) (*deadLetter, error) {
+	d := &deadLetter{
+		target:  target,
+		timeout: timeout,
+		queue:   make(chan deadLetterEvent, size),
+		done:    make(chan struct{}),
+	}
+	if target == "" {
+		return d, nil
+	}
+
+	u := cloudevents.ParseURI(target)
+	if u == nil {
+		return nil, fmt.Errorf("invalid dead letter sink %q", target)
+	}
+	p, err := newHTTPProtocol(*u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.client, err = cloudevents.NewClient(p, cloudevents.WithTimeNow(), cloudevents.WithUUIDs()); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// add queues the undeliverable event, without blocking. Events are dropped if
+// there is no dead letter sink or its queue is full.
+func (d *deadLetter) add(sk *sink, event cloudevents.Event, reason error) {
+	if d.client == nil {
+		sk.logger.Warnw("dropping undeliverable event", "type", event.Type(), "reason", reason.Error())
+		return
+	}
+	select {
+	case d.queue <- deadLetterEvent{sk: sk, event: event, reason: reason}:
+	default:
+		sk.logger.Errorw("dropping undeliverable event, dead letter queue is full", "type", event.Type(), "reason", reason.Error())
+	}
+}
+
+// run sends the queued events until stop.
+func (d *deadLetter) run() {
+	defer close(d.done)
+	for dl := range d.queue {
+		d.send(dl.sk, dl.event, dl.reason)
+	}
+}
+
+// stop sends the remaining queued events and then stops run, the returned
+// channel is closed once it has. Nothing may be added after stop.
+func (d *deadLetter) stop() <-chan struct{} {
+	close(d.queue)
+	return d.done
+}
+
+func (d *deadLetter) send(sk *sink, event cloudevents.Event, reason error) {
+	event = event.Clone()
+	event.SetExtension("deadlettersubscription", sk.ID)
+	if sk.Tenant != "" {
+		event.SetExtension("deadlettertenant", sk.Tenant)
+	}
+	event.SetExtension("deadlettersink", sk.Sink.String())
+	event.SetExtension("deadletterreason", reason.Error())
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	if result := d.client.Send(ctx, event); !cloudevents.IsACK(result) {
+		sk.logger.Errorw("failed to deliver event to dead letter sink", "type", event.Type(), "deadlettersink", d.target, zap.Error(result))
+	}
+}
+
+var errQueueFull = errors.New("sink delivery queue is full")
+
+// enqueue queues the event for delivery, without blocking. Filtered events
+// are not queued. Queued events are numbered in the sequence extension, so
+// the receiver can tell when events were lost.
+func (s *sink) enqueue(event cloudevents.Event) {
+	if s.filtered(&event) {
+		return
+	}
+	*s.sequence++
+	event = event.Clone()
+	event.SetExtension("sequence", strconv.FormatUint(*s.sequence, 10))
+	select {
+	case s.queue <- event:
+	default:
+		metrics.DeliveryFailures.WithLabelValues(s.Protocol).Inc()
+		s.deadLetter.add(s, event, errQueueFull)
+	}
+}
+
+// stop delivers the remaining queued events and then stops the sink.
+func (s *sink) stop() {
+	close(s.queue)
+}
+
+// run delivers queued events until the queue is closed or ctx is done.
+func (s *sink) run(ctx context.Context) {
+	defer func() {
+		if c, ok := s.protocol.(protocol.Closer); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := c.Close(ctx); err != nil {
+				s.logger.Warnw("failed to close sink", zap.Error(err))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			if err := s.deliver(ctx, event); err != nil {
+				metrics.DeliveryFailures.WithLabelValues(s.Protocol).Inc()
+				s.deadLetter.add(s, event, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send makes a single delivery attempt, traced as a child of the event's
+// trace context.
+func (s *sink) send(ctx context.Context, event cloudevents.Event, attempt int) error {
+	ctx, span := tracing.Tracer().Start(tracing.ExtractEvent(ctx, event), "vent.deliver",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("cloudmeta.subscription.id", s.ID),
+			attribute.String("cloudmeta.subscription.tenant", s.Tenant),
+			attribute.String("cloudmeta.subscription.protocol", s.Protocol),
+			attribute.String("cloudevents.event_type", event.Type()),
+			attribute.Int("cloudmeta.delivery.attempt", attempt),
+		))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, s.retry.timeout)
+	defer cancel()
+	start := time.Now()
+	result := s.client.Send(ctx, event)
+	metrics.DeliveryDuration.WithLabelValues(s.Protocol).Observe(time.Since(start).Seconds())
+	if !cloudevents.IsACK(result) {
+		span.RecordError(result)
+		span.SetStatus(codes.Error, result.Error())
+	}
+	return result
+}
+
+// deliver sends the event, retrying with exponential backoff.
+func (s *sink) deliver(ctx context.Context, event cloudevents.Event) error {
+	backoff := s.retry.backoff
+	for attempt := 1; ; attempt++ {
+		result := s.send(ctx, event, attempt)
+		if cloudevents.IsACK(result) {
+			metrics.DeliveryAttempts.WithLabelValues(s.Protocol, "ok").Inc()
+			return nil
+		}
+		metrics.DeliveryAttempts.WithLabelValues(s.Protocol, "error").Inc()
+		s.logger.Warnw("failed to deliver event", "type", event.Type(), "attempt", attempt, "maxattempts", s.retry.maxAttempts, zap.Error(result))
+		if attempt >= s.retry.maxAttempts {
+			return fmt.Errorf("failed after %d attempts: %v", attempt, result)
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
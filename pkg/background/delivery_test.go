@@ -0,0 +1,150 @@
+package background
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+func TestRetryFor(t *testing.T) {
+	defaults := DeliveryConfig{MaxAttempts: 3, Backoff: time.Second, Timeout: 10 * time.Second}
+	attempts := func(n int) *int { return &n }
+	tests := map[string]struct {
+		policy  *subscription.RetryPolicy
+		want    retryPolicy
+		wantErr bool
+	}{
+		"defaults": {
+			want: retryPolicy{maxAttempts: 3, backoff: time.Second, timeout: 10 * time.Second},
+		},
+		"empty policy": {
+			policy: &subscription.RetryPolicy{},
+			want:   retryPolicy{maxAttempts: 3, backoff: time.Second, timeout: 10 * time.Second},
+		},
+		"overrides": {
+			policy: &subscription.RetryPolicy{MaxAttempts: attempts(5), Backoff: "500ms", Timeout: "5s"},
+			want:   retryPolicy{maxAttempts: 5, backoff: 500 * time.Millisecond, timeout: 5 * time.Second},
+		},
+		"no attempts": {
+			policy:  &subscription.RetryPolicy{MaxAttempts: attempts(0)},
+			wantErr: true,
+		},
+		"bad backoff": {
+			policy:  &subscription.RetryPolicy{Backoff: "soon"},
+			wantErr: true,
+		},
+		"zero timeout": {
+			policy:  &subscription.RetryPolicy{Timeout: "0s"},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := defaults.retryFor(tc.policy)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+			if err == nil && got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeliverBacksOff(t *testing.T) {
+	failing := newTestSink(t, http.StatusInternalServerError)
+	v := newTestVent(t, DeliveryConfig{}, nil, nil)
+	sub := subscriptionTo(t, "sub", failing.URL, `{"retry":{"maxattempts":3,"backoff":"50ms"}}`)
+	sk, err := v.newSink(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sk.deliver(context.Background(), testEvent()); err == nil {
+		t.Fatal("delivery to a failing sink succeeded")
+	}
+	attempts := failing.requests()
+	if len(attempts) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(attempts))
+	}
+	// The backoff doubles after each retry.
+	for i, want := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond} {
+		if got := attempts[i+1].at.Sub(attempts[i].at); got < want {
+			t.Errorf("retry %d after %s, want at least %s", i+1, got, want)
+		}
+	}
+}
+
+func TestFullQueueDeadLetters(t *testing.T) {
+	sink := newTestSink(t, http.StatusOK)
+	dead := newTestSink(t, http.StatusOK)
+	v := newTestVent(t, DeliveryConfig{QueueSize: 1, DeadLetterSink: dead.URL}, nil, nil)
+	sk, err := v.newSink(subscriptionTo(t, "sub", sink.URL, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sink is not running, so the second event does not fit its queue.
+	sk.enqueue(testEvent())
+	sk.enqueue(testEvent())
+	go v.deadLetter.run()
+	<-v.deadLetter.stop()
+
+	got := dead.wait(t, 1)
+	if len(got) != 1 {
+		t.Fatalf("dead letter sink received %d events, want 1", len(got))
+	}
+	ext := got[0].event.Extensions()
+	if ext["sequence"] != "2" || ext["deadlettersubscription"] != "sub" || ext["deadletterreason"] != errQueueFull.Error() {
+		t.Errorf("got dead letter extensions %v", ext)
+	}
+}
+
+func TestVentDeadLettersBeforeStopping(t *testing.T) {
+	failing := newTestSink(t, http.StatusInternalServerError)
+	dead := newTestSink(t, http.StatusOK)
+	changes := make(chan SubscriptionChange, 1)
+	changes <- SubscriptionChange{Change: "added", Subscription: subscriptionTo(t, "sub", failing.URL, "")}
+	v := newTestVent(t, DeliveryConfig{MaxAttempts: 1, DeadLetterSink: dead.URL}, nil, changes)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- v.Start(ctx)
+	}()
+	eventually(t, func() bool { return len(changes) == 0 }, "subscription was not added")
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	// The failed subscribed event was dead-lettered before Start returned.
+	got := dead.requests()
+	if len(got) != 1 {
+		t.Fatalf("dead letter sink received %d events, want 1", len(got))
+	}
+	if got := got[0].event.Type(); got != "cloudmeta.discovery.service.subscribed.v1" {
+		t.Errorf("got dead letter of type %q", got)
+	}
+}
+
+func TestNewVentInvalidSinks(t *testing.T) {
+	for name, tc := range map[string]struct {
+		sinks    string
+		delivery DeliveryConfig
+	}{
+		"manual sink":      {sinks: "http://ok.test, ://bad"},
+		"dead letter sink": {delivery: DeliveryConfig{DeadLetterSink: "://bad"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewVent("http://cloudmeta.test", tc.sinks, tc.delivery, nil, nil, zap.NewNop().Sugar()); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
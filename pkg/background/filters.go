@@ -0,0 +1,138 @@
+package background
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/cesql"
+)
+
+// matcher returns true if the event passes the filter expression.
+type matcher func(e *event.Event) (bool, error)
+
+// compileAll compiles filter expressions that all must match, as used for a
+// subscription's filters.
+func compileAll(filters []subscription.FilterExpression) (matcher, error) {
+	ms, err := compileList(filters)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *event.Event) (bool, error) {
+		for _, m := range ms {
+			if ok, err := m(e); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+func compileAny(filters []subscription.FilterExpression) (matcher, error) {
+	ms, err := compileList(filters)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *event.Event) (bool, error) {
+		for _, m := range ms {
+			if ok, err := m(e); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}, nil
+}
+
+func compileList(filters []subscription.FilterExpression) ([]matcher, error) {
+	ms := make([]matcher, 0, len(filters))
+	for _, f := range filters {
+		m, err := compileFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func compileFilter(f subscription.FilterExpression) (matcher, error) {
+	switch {
+	case f.Exact != nil:
+		return attributeMatcher(f.Exact, func(v, want string) bool { return v == want })
+	case f.Prefix != nil:
+		return attributeMatcher(f.Prefix, strings.HasPrefix)
+	case f.Suffix != nil:
+		return attributeMatcher(f.Suffix, strings.HasSuffix)
+	case f.All != nil:
+		return compileAll(f.All)
+	case f.Any != nil:
+		return compileAny(f.Any)
+	case f.Not != nil:
+		m, err := compileFilter(*f.Not)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *event.Event) (bool, error) {
+			ok, err := m(e)
+			return !ok && err == nil, err
+		}, nil
+	case f.SQL != "":
+		x, err := cesql.Parse(f.SQL)
+		if err != nil {
+			return nil, err
+		}
+		return x.Match, nil
+	}
+	return nil, fmt.Errorf("empty filter expression")
+}
+
+// attributeMatcher matches the single attribute in attrs. Events without the
+// attribute do not match.
+func attributeMatcher(attrs map[string]string, match func(v, want string) bool) (matcher, error) {
+	if len(attrs) != 1 {
+		return nil, fmt.Errorf("filter must name exactly one attribute, got %d", len(attrs))
+	}
+	var name, want string
+	for name, want = range attrs {
+	}
+	return func(e *event.Event) (bool, error) {
+		v, ok := attributeValue(e, name)
+		return ok && match(v, want), nil
+	}, nil
+}
+
+// attributeValue returns the string value of the context attribute or
+// extension with the given name.
+func attributeValue(e *event.Event, name string) (string, bool) {
+	switch name {
+	case "specversion":
+		return e.SpecVersion(), true
+	case "type":
+		return e.Type(), true
+	case "source":
+		return e.Source(), true
+	case "subject":
+		return e.Subject(), e.Subject() != ""
+	case "id":
+		return e.ID(), true
+	case "time":
+		if e.Time().IsZero() {
+			return "", false
+		}
+		v, _ := types.ToString(e.Time())
+		return v, true
+	case "dataschema":
+		return e.DataSchema(), e.DataSchema() != ""
+	case "datacontenttype":
+		return e.DataContentType(), e.DataContentType() != ""
+	default:
+		ext, ok := e.Extensions()[name]
+		if !ok {
+			return "", false
+		}
+		v, err := types.ToString(ext)
+		return v, err == nil
+	}
+}
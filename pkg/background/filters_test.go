@@ -0,0 +1,93 @@
+package background
+
+import (
+	"encoding/json"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+func TestCompileFilter(t *testing.T) {
+	// The event is a service added event with a sequence extension.
+	tests := map[string]struct {
+		filter  string
+		want    bool
+		wantErr bool
+	}{
+		"exact":                  {filter: `{"exact":{"type":"cloudmeta.discovery.service.added.v1"}}`, want: true},
+		"exact mismatch":         {filter: `{"exact":{"type":"cloudmeta.discovery.service"}}`},
+		"exact extension":        {filter: `{"exact":{"sequence":"2"}}`, want: true},
+		"exact missing":          {filter: `{"exact":{"dataschema":""}}`},
+		"exact two attributes":   {filter: `{"exact":{"type":"a","source":"b"}}`, wantErr: true},
+		"exact no attributes":    {filter: `{"exact":{}}`, wantErr: true},
+		"prefix":                 {filter: `{"prefix":{"type":"cloudmeta.discovery."}}`, want: true},
+		"prefix mismatch":        {filter: `{"prefix":{"type":"com.example."}}`},
+		"prefix missing":         {filter: `{"prefix":{"partitionkey":""}}`},
+		"suffix":                 {filter: `{"suffix":{"subject":"/abc"}}`, want: true},
+		"suffix mismatch":        {filter: `{"suffix":{"subject":"/def"}}`},
+		"all":                    {filter: `{"all":[{"prefix":{"type":"cloudmeta."}},{"suffix":{"subject":"abc"}}]}`, want: true},
+		"all one mismatch":       {filter: `{"all":[{"prefix":{"type":"cloudmeta."}},{"suffix":{"subject":"def"}}]}`},
+		"all empty":              {filter: `{"all":[]}`, want: true},
+		"any":                    {filter: `{"any":[{"exact":{"id":"2"}},{"exact":{"id":"1"}}]}`, want: true},
+		"any none":               {filter: `{"any":[{"exact":{"id":"2"}},{"exact":{"id":"3"}}]}`},
+		"not":                    {filter: `{"not":{"exact":{"id":"2"}}}`, want: true},
+		"not match":              {filter: `{"not":{"exact":{"id":"1"}}}`},
+		"sql":                    {filter: `{"sql":"type LIKE '%.added.v1' AND sequence = '2'"}`, want: true},
+		"sql mismatch":           {filter: `{"sql":"subject = '/services/def'"}`},
+		"sql invalid":            {filter: `{"sql":"type ="}`, wantErr: true},
+		"nested":                 {filter: `{"all":[{"any":[{"exact":{"id":"9"}},{"not":{"prefix":{"source":"https:"}}}]},{"sql":"sequence = '2'"}]}`, want: true},
+		"nested mismatch":        {filter: `{"not":{"any":[{"all":[{"exact":{"id":"1"}}]},{"exact":{"id":"9"}}]}}`},
+		"nested invalid":         {filter: `{"any":[{"exact":{"id":"1"}},{"not":{"sql":"("}}]}`, wantErr: true},
+		"unknown dialect":        {filter: `{"regex":{"type":".*"}}`, wantErr: true},
+		"nested unknown dialect": {filter: `{"all":[{"exact":{"id":"1"}},{"glob":{"type":"*"}}]}`, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var f subscription.FilterExpression
+			if err := json.Unmarshal([]byte(tc.filter), &f); err != nil {
+				t.Fatal(err)
+			}
+			m, err := compileFilter(f)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			e := testEvent()
+			got, err := m(&e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAttributeValue(t *testing.T) {
+	e := testEvent()
+	tests := map[string]struct {
+		want   string
+		wantOK bool
+	}{
+		"specversion":     {want: cloudevents.VersionV1, wantOK: true},
+		"id":              {want: "1", wantOK: true},
+		"source":          {want: "http://cloudmeta.test", wantOK: true},
+		"subject":         {want: "/services/abc", wantOK: true},
+		"datacontenttype": {want: cloudevents.ApplicationJSON, wantOK: true},
+		"sequence":        {want: "2", wantOK: true},
+		"time":            {},
+		"dataschema":      {},
+		"partitionkey":    {},
+	}
+	for name, tc := range tests {
+		got, ok := attributeValue(&e, name)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: got %q, %t, want %q, %t", name, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
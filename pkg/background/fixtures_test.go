@@ -0,0 +1,237 @@
+package background
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// eventually fails the test unless done returns true within five seconds,
+// describing what did not happen with the format and args.
+func eventually(t *testing.T, done func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// received is a request to a testSink.
+type received struct {
+	at     time.Time
+	method string
+	header http.Header
+	event  cloudevents.Event
+}
+
+// testSink is an HTTP sink that records the requests it receives, answering
+// each with its status.
+type testSink struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []received
+}
+
+func newTestSink(t *testing.T, status int) *testSink {
+	s := new(testSink)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at := time.Now()
+		event, err := binding.ToEvent(r.Context(), cehttp.NewMessageFromHttpRequest(r))
+		if err != nil {
+			t.Errorf("sink received an invalid event: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.received = append(s.received, received{at: at, method: r.Method, header: r.Header.Clone(), event: *event})
+		s.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requests returns the requests received so far.
+func (s *testSink) requests() []received {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]received(nil), s.received...)
+}
+
+// wait returns the received requests, once there are n.
+func (s *testSink) wait(t *testing.T, n int) []received {
+	t.Helper()
+	var got []received
+	eventually(t, func() bool {
+		got = s.requests()
+		return len(got) >= n
+	}, "sink received fewer than %d events", n)
+	return got
+}
+
+// subscriptionTo returns an HTTP subscription to the sink with the protocol
+// settings.
+func subscriptionTo(t *testing.T, id, sink, settings string) subscription.Subscription {
+	t.Helper()
+	u := types.ParseURI(sink)
+	if u == nil {
+		t.Fatalf("invalid sink url %q", sink)
+	}
+	sub := subscription.Subscription{ID: id, Protocol: "HTTP", Sink: *u}
+	if settings != "" {
+		raw := json.RawMessage(settings)
+		sub.ProtocolSettings = &raw
+	}
+	if err := sub.SetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+// testEvent returns an event for sending straight to a protocol sender.
+func testEvent() cloudevents.Event {
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetType("cloudmeta.discovery.service.added.v1")
+	e.SetSource("http://cloudmeta.test")
+	e.SetSubject("/services/abc")
+	e.SetExtension("sequence", "2")
+	_ = e.SetData(cloudevents.ApplicationJSON, map[string]string{"change": "added"})
+	return e
+}
+
+// newTestVent returns a vent of the service and subscription changes, either
+// of which may be nil.
+func newTestVent(t *testing.T, delivery DeliveryConfig, changes <-chan ServiceChange, subs <-chan SubscriptionChange) *Vent {
+	t.Helper()
+	v, err := NewVent("http://cloudmeta.test", "", delivery, changes, subs, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// startVent runs a vent for the subscriptions, venting the changes of the
+// returned store.
+func startVent(t *testing.T, subs ...subscription.Subscription) ServiceStore {
+	t.Helper()
+	store := NewServiceStore()
+	changes := make(chan SubscriptionChange, len(subs))
+	for _, sub := range subs {
+		changes <- SubscriptionChange{Change: "added", Subscription: sub}
+	}
+	vent := newTestVent(t, DeliveryConfig{MaxAttempts: 1}, store.Watch(), changes)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vent.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return store
+}
+
+// fakeServices is a ServicesManager that holds the services.
+type fakeServices struct {
+	mu       sync.Mutex
+	services map[string]discovery.Service
+}
+
+func (f *fakeServices) Set(_ context.Context, service discovery.Service) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stored, found := f.services[service.ID]; !found || stored.Epoch < service.Epoch {
+		f.services[service.ID] = service
+	}
+}
+
+func (f *fakeServices) Delete(_ context.Context, service discovery.Service) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stored, found := f.services[service.ID]; found && stored.Epoch <= service.Epoch {
+		delete(f.services, service.ID)
+	}
+}
+
+func (f *fakeServices) ids() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]string, 0, len(f.services))
+	for _, id := range []string{"a", "b", "c", "z"} {
+		if _, found := f.services[id]; found {
+			ids = append(ids, id)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+// fakeDownstream lists its services once released, and holds the
+// subscription made to it.
+type fakeDownstream struct {
+	*httptest.Server
+	// listing is closed when the services are requested.
+	listing chan struct{}
+	release chan struct{}
+
+	mu    sync.Mutex
+	sub   *subscription.Subscription
+	lists int
+}
+
+func newFakeDownstream(t *testing.T, services ...discovery.Service) *fakeDownstream {
+	f := &fakeDownstream{listing: make(chan struct{}), release: make(chan struct{})}
+	var once sync.Once
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/services":
+			once.Do(func() { close(f.listing) })
+			f.mu.Lock()
+			f.lists++
+			f.mu.Unlock()
+			<-f.release
+			_ = json.NewEncoder(w).Encode(services)
+		case r.URL.Path == "/subscriptions" && r.Method == http.MethodPut:
+			sub := new(subscription.Subscription)
+			if err := json.NewDecoder(r.Body).Decode(sub); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.mu.Lock()
+			f.sub = sub
+			f.mu.Unlock()
+			_ = json.NewEncoder(w).Encode(sub)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// listed returns how many times the services were listed.
+func (f *fakeDownstream) listed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
@@ -0,0 +1,22 @@
+package background
+
+import (
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// newHTTPProtocol returns a protocol that sends to target, applying the
+// custom headers and method from settings to every request.
+func newHTTPProtocol(target types.URI, settings *subscription.HTTPProtocol) (*cehttp.Protocol, error) {
+	opts := []cehttp.Option{cehttp.WithTarget(target.String())}
+	if settings != nil {
+		if settings.Method != "" {
+			opts = append(opts, cehttp.WithMethod(settings.Method))
+		}
+		for k, v := range settings.Headers {
+			opts = append(opts, cehttp.WithHeader(k, v))
+		}
+	}
+	return cehttp.New(opts...)
+}
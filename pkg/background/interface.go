@@ -10,5 +10,7 @@ type Background interface {
 }
 
 type ServicesManager interface {
-	Set(service discovery.Service)
+	Set(ctx context.Context, service discovery.Service)
+	// Delete removes the service, unless a newer epoch of it is stored.
+	Delete(ctx context.Context, service discovery.Service)
 }
@@ -0,0 +1,224 @@
+package background
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/spec"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// Based on https://github.com/cloudevents/spec/blob/v1.0/kafka-protocol-binding.md
+
+const kafkaHeaderPrefix = "ce_"
+
+// kafkaMessage is a CloudEvent written in binary mode for the Kafka binding.
+type kafkaMessage struct {
+	headers []sarama.RecordHeader
+	value   []byte
+}
+
+var _ binding.BinaryWriter = (*kafkaMessage)(nil)
+
+func (m *kafkaMessage) Start(_ context.Context) error {
+	m.headers = make([]sarama.RecordHeader, 0)
+	return nil
+}
+
+func (m *kafkaMessage) SetAttribute(attribute spec.Attribute, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	s, err := types.Format(value)
+	if err != nil {
+		return err
+	}
+	if attribute.Kind() == spec.DataContentType {
+		m.header("content-type", s)
+		return nil
+	}
+	m.header(kafkaHeaderPrefix+attribute.Name(), s)
+	return nil
+}
+
+func (m *kafkaMessage) SetExtension(name string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	s, err := types.Format(value)
+	if err != nil {
+		return err
+	}
+	m.header(kafkaHeaderPrefix+name, s)
+	return nil
+}
+
+func (m *kafkaMessage) SetData(data io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, data); err != nil {
+		return err
+	}
+	m.value = buf.Bytes()
+	return nil
+}
+
+func (m *kafkaMessage) End(_ context.Context) error {
+	return nil
+}
+
+func (m *kafkaMessage) header(key, value string) {
+	m.headers = append(m.headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+// kafkaAcks maps the ACKs protocol setting to the producer's required acks.
+func kafkaAcks(acks string) (sarama.RequiredAcks, error) {
+	switch strings.ToLower(acks) {
+	case "", "1", "leader":
+		return sarama.WaitForLocal, nil
+	case "0", "none":
+		return sarama.NoResponse, nil
+	case "-1", "all":
+		return sarama.WaitForAll, nil
+	default:
+		return 0, fmt.Errorf("unsupported kafka acks %q, must be one of 0, 1 or all", acks)
+	}
+}
+
+// kafkaPartitionKey evaluates the partition key extractor against the event.
+// The extractor names the attribute or extension holding the key, and
+// defaults to the "partitionkey" extension. An event without the attribute
+// has no key.
+func kafkaPartitionKey(extractor string, e *event.Event) (string, bool) {
+	name := strings.ToLower(strings.TrimSpace(extractor))
+	if name == "" {
+		name = "partitionkey"
+	}
+	value, ok := attributeValue(e, name)
+	if !ok || value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+// kafkaSender produces binary mode CloudEvents to a Kafka topic.
+type kafkaSender struct {
+	brokers   []string
+	config    *sarama.Config
+	topic     string
+	extractor string
+
+	mu       sync.Mutex
+	producer sarama.SyncProducer
+}
+
+// newKafkaSender sends to the brokers in the sink's host, which may be a
+// comma separated list, e.g. kafka://broker-0:9092,broker-1:9092/topic.
+func newKafkaSender(id string, sink types.URI, settings *subscription.KafkaProtocol) (*kafkaSender, error) {
+	if settings == nil {
+		settings = new(subscription.KafkaProtocol)
+	}
+	acks, err := kafkaAcks(settings.ACKs)
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_0_0 // headers need at least 0.11.
+	config.ClientID = settings.ClientID
+	if config.ClientID == "" {
+		config.ClientID = fmt.Sprintf("cloudmeta-%s", id)
+	}
+	config.Producer.RequiredAcks = acks
+	config.Producer.Return.Successes = true // required by the sync producer.
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	topic := settings.TopicName
+	if topic == "" {
+		topic = strings.TrimPrefix(sink.Path, "/")
+	}
+
+	return &kafkaSender{
+		brokers:   strings.Split(sink.Host, ","),
+		config:    config,
+		topic:     topic,
+		extractor: settings.PartitionKeyExtractor,
+	}, nil
+}
+
+// connect lazily creates the producer, so an unreachable cluster does not
+// fail the subscription, only its deliveries.
+func (s *kafkaSender) connect() (sarama.SyncProducer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.producer != nil {
+		return s.producer, nil
+	}
+	producer, err := sarama.NewSyncProducer(s.brokers, s.config)
+	if err != nil {
+		return nil, err
+	}
+	s.producer = producer
+	return producer, nil
+}
+
+func (s *kafkaSender) Send(ctx context.Context, m binding.Message, transformers ...binding.Transformer) (err error) {
+	defer func() { _ = m.Finish(err) }()
+
+	e, err := binding.ToEvent(ctx, m, transformers...)
+	if err != nil {
+		return err
+	}
+
+	msg := new(kafkaMessage)
+	if _, err = binding.Write(ctx, (*binding.EventMessage)(e), nil, msg); err != nil {
+		return err
+	}
+
+	pm := &sarama.ProducerMessage{
+		Topic:   s.topic,
+		Headers: msg.headers,
+		Value:   sarama.ByteEncoder(msg.value),
+	}
+	if key, ok := kafkaPartitionKey(s.extractor, e); ok {
+		pm.Key = sarama.StringEncoder(key)
+	}
+
+	// The producer does not take a context, so the attempt is abandoned when
+	// ctx is done. The message may still be produced after, which a retry
+	// will duplicate.
+	sent := make(chan error, 1)
+	go func() {
+		producer, err := s.connect()
+		if err == nil {
+			_, _, err = producer.SendMessage(pm)
+		}
+		sent <- err
+	}()
+	select {
+	case err = <-sent:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *kafkaSender) Close(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.producer == nil {
+		return nil
+	}
+	err := s.producer.Close()
+	s.producer = nil
+	return err
+}
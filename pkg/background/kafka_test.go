@@ -0,0 +1,130 @@
+package background
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/types"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+func kafkaSink(t *testing.T, hosts, path string) types.URI {
+	t.Helper()
+	u := types.ParseURI("kafka://" + hosts + path)
+	if u == nil {
+		t.Fatalf("invalid sink kafka://%s%s", hosts, path)
+	}
+	return *u
+}
+
+func TestKafkaSenderSettings(t *testing.T) {
+	s, err := newKafkaSender("sub", kafkaSink(t, "broker-0:9092,broker-1:9092", "/services"), &subscription.KafkaProtocol{ACKs: "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.brokers) != 2 || s.brokers[0] != "broker-0:9092" || s.brokers[1] != "broker-1:9092" {
+		t.Errorf("got brokers %v, want both hosts of the sink", s.brokers)
+	}
+	if s.topic != "services" {
+		t.Errorf("got topic %q, want the sink path services", s.topic)
+	}
+	if s.config.Producer.RequiredAcks != sarama.WaitForAll {
+		t.Errorf("got acks %v, want all", s.config.Producer.RequiredAcks)
+	}
+	if s.config.ClientID != "cloudmeta-sub" {
+		t.Errorf("got client id %q, want cloudmeta-sub", s.config.ClientID)
+	}
+}
+
+func TestKafkaSenderInvalidACKs(t *testing.T) {
+	if _, err := newKafkaSender("sub", kafkaSink(t, "broker:9092", "/services"), &subscription.KafkaProtocol{ACKs: "2"}); err == nil {
+		t.Error("kafka sender accepted acks 2")
+	}
+}
+
+func TestKafkaSenderMessage(t *testing.T) {
+	s, err := newKafkaSender("sub", kafkaSink(t, "broker:9092", "/ignored"), &subscription.KafkaProtocol{
+		TopicName:             "services",
+		PartitionKeyExtractor: "subject",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := mocks.NewSyncProducer(t, s.config)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(pm *sarama.ProducerMessage) error {
+		if pm.Topic != "services" {
+			return fmt.Errorf("got topic %q, want services", pm.Topic)
+		}
+		if key, _ := pm.Key.Encode(); string(key) != "/services/abc" {
+			return fmt.Errorf("got key %q, want the subject", key)
+		}
+		headers := make(map[string]string)
+		for _, h := range pm.Headers {
+			headers[string(h.Key)] = string(h.Value)
+		}
+		for k, v := range map[string]string{
+			"ce_specversion": "1.0",
+			"ce_id":          "1",
+			"ce_type":        "cloudmeta.discovery.service.added.v1",
+			"ce_source":      "http://cloudmeta.test",
+			"ce_subject":     "/services/abc",
+			"ce_sequence":    "2",
+			"content-type":   "application/json",
+		} {
+			if headers[k] != v {
+				return fmt.Errorf("got header %s %q, want %q", k, headers[k], v)
+			}
+		}
+		if value, _ := pm.Value.Encode(); string(value) != `{"change":"added"}` {
+			return fmt.Errorf("got value %s, want the event data", value)
+		}
+		return nil
+	})
+	s.producer = producer
+	defer s.Close(context.Background())
+
+	e := testEvent()
+	if err := s.Send(context.Background(), binding.ToMessage(&e)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafkaSenderProducesToBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("services", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	s, err := newKafkaSender("sub", kafkaSink(t, broker.Addr(), "/services"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e := testEvent()
+	if err := s.Send(ctx, binding.ToMessage(&e)); err != nil {
+		t.Fatal(err)
+	}
+
+	produced := false
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced = true
+		}
+	}
+	if !produced {
+		t.Error("broker received no produce request")
+	}
+}
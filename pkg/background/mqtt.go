@@ -0,0 +1,303 @@
+package background
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/format"
+	"github.com/cloudevents/sdk-go/v2/binding/spec"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// Based on https://github.com/cloudevents/spec/blob/v1.0/mqtt-protocol-binding.md
+
+// mqttMessage is a CloudEvent written for the MQTT binding. Binary mode is
+// only supported by MQTT 5, where attributes are carried as user properties.
+type mqttMessage struct {
+	contentType string
+	properties  paho.UserProperties
+	payload     []byte
+}
+
+var _ binding.StructuredWriter = (*mqttMessage)(nil)
+var _ binding.BinaryWriter = (*mqttMessage)(nil)
+
+func (m *mqttMessage) SetStructuredEvent(_ context.Context, f format.Format, event io.Reader) error {
+	m.contentType = f.MediaType()
+	return m.SetData(event)
+}
+
+func (m *mqttMessage) Start(_ context.Context) error {
+	m.properties = make(paho.UserProperties, 0)
+	return nil
+}
+
+func (m *mqttMessage) SetAttribute(attribute spec.Attribute, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	s, err := types.Format(value)
+	if err != nil {
+		return err
+	}
+	if attribute.Kind() == spec.DataContentType {
+		m.contentType = s
+		return nil
+	}
+	m.properties.Add(attribute.Name(), s)
+	return nil
+}
+
+func (m *mqttMessage) SetExtension(name string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	s, err := types.Format(value)
+	if err != nil {
+		return err
+	}
+	m.properties.Add(name, s)
+	return nil
+}
+
+func (m *mqttMessage) SetData(data io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, data); err != nil {
+		return err
+	}
+	m.payload = buf.Bytes()
+	return nil
+}
+
+func (m *mqttMessage) End(_ context.Context) error {
+	return nil
+}
+
+// mqttTopic returns the topic from settings, falling back to the sink path.
+func mqttTopic(topic string, sink types.URI) string {
+	if topic != "" {
+		return topic
+	}
+	return strings.TrimPrefix(sink.Path, "/")
+}
+
+// mqttQoS maps the QOS protocol setting, which defaults to at least once.
+func mqttQoS(qos *int) (byte, error) {
+	if qos == nil {
+		return 1, nil
+	}
+	if *qos < 0 || *qos > 2 {
+		return 0, fmt.Errorf("unsupported mqtt qos %d, must be 0, 1 or 2", *qos)
+	}
+	return byte(*qos), nil
+}
+
+// mqtt3Sender publishes structured mode CloudEvents over MQTT 3.1.1.
+type mqtt3Sender struct {
+	client   mqtt.Client
+	topic    string
+	qos      byte
+	settings subscription.MQTT3Protocol
+}
+
+func newMQTT3Sender(id string, sink types.URI, settings *subscription.MQTT3Protocol) (*mqtt3Sender, error) {
+	if settings == nil {
+		settings = new(subscription.MQTT3Protocol)
+	}
+	qos, err := mqttQoS(settings.QOS)
+	if err != nil {
+		return nil, err
+	}
+	broker := sink.URL
+	switch broker.Scheme {
+	case "mqtt":
+		broker.Scheme = "tcp"
+	case "mqtts":
+		broker.Scheme = "ssl"
+	}
+	broker.Path = ""
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker.String()).
+		SetClientID(mqttClientID(id)).
+		SetAutoReconnect(true)
+	if u := sink.User; u != nil {
+		opts.SetUsername(u.Username())
+		if p, ok := u.Password(); ok {
+			opts.SetPassword(p)
+		}
+	}
+
+	return &mqtt3Sender{
+		client:   mqtt.NewClient(opts),
+		topic:    mqttTopic(settings.TopicName, sink),
+		qos:      qos,
+		settings: *settings,
+	}, nil
+}
+
+func (s *mqtt3Sender) Send(ctx context.Context, m binding.Message, transformers ...binding.Transformer) (err error) {
+	defer func() { _ = m.Finish(err) }()
+
+	if !s.client.IsConnected() {
+		if err = mqttWait(ctx, s.client.Connect()); err != nil {
+			return err
+		}
+	}
+
+	// MQTT 3.1.1 only supports structured mode.
+	msg := new(mqttMessage)
+	if _, err = binding.Write(ctx, m, msg, nil, transformers...); err != nil {
+		return err
+	}
+
+	err = mqttWait(ctx, s.client.Publish(s.topic, s.qos, s.settings.Retain, msg.payload))
+	return err
+}
+
+func (s *mqtt3Sender) Close(_ context.Context) error {
+	s.client.Disconnect(250)
+	return nil
+}
+
+func mqttWait(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mqtt5Sender publishes binary mode CloudEvents over MQTT 5.
+type mqtt5Sender struct {
+	config   autopaho.ClientConfig
+	topic    string
+	qos      byte
+	settings subscription.MQTT5Protocol
+
+	mu     sync.Mutex
+	conn   *autopaho.ConnectionManager
+	cancel context.CancelFunc
+}
+
+func newMQTT5Sender(id string, sink types.URI, settings *subscription.MQTT5Protocol) (*mqtt5Sender, error) {
+	if settings == nil {
+		settings = new(subscription.MQTT5Protocol)
+	}
+	qos, err := mqttQoS(settings.QOS)
+	if err != nil {
+		return nil, err
+	}
+	broker := sink.URL
+	switch broker.Scheme {
+	case "tcp":
+		broker.Scheme = "mqtt"
+	case "ssl", "tls":
+		broker.Scheme = "mqtts"
+	}
+	broker.Path = ""
+
+	config := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{&broker},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ClientConfig: paho.ClientConfig{
+			ClientID: mqttClientID(id),
+		},
+	}
+	if u := sink.User; u != nil {
+		config.ConnectUsername = u.Username()
+		if p, ok := u.Password(); ok {
+			config.ConnectPassword = []byte(p)
+		}
+	}
+
+	return &mqtt5Sender{
+		config:   config,
+		topic:    mqttTopic(settings.TopicName, sink),
+		qos:      qos,
+		settings: *settings,
+	}, nil
+}
+
+// connect lazily starts the connection manager, which reconnects on its own.
+func (s *mqtt5Sender) connect() (*autopaho.ConnectionManager, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return s.conn, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := autopaho.NewConnection(ctx, s.config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.conn, s.cancel = conn, cancel
+	return conn, nil
+}
+
+func (s *mqtt5Sender) Send(ctx context.Context, m binding.Message, transformers ...binding.Transformer) (err error) {
+	defer func() { _ = m.Finish(err) }()
+
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err = conn.AwaitConnection(ctx); err != nil {
+		return err
+	}
+
+	msg := new(mqttMessage)
+	if _, err = binding.Write(ctx, m, msg, msg, transformers...); err != nil {
+		return err
+	}
+
+	props := &paho.PublishProperties{
+		ContentType: msg.contentType,
+		User:        msg.properties,
+	}
+	for k, v := range s.settings.UserProperties {
+		props.User.Add(k, v)
+	}
+	if s.settings.Expiry != nil {
+		expiry := uint32(*s.settings.Expiry)
+		props.MessageExpiry = &expiry
+	}
+
+	_, err = conn.Publish(ctx, &paho.Publish{
+		QoS:        s.qos,
+		Retain:     s.settings.Retain,
+		Topic:      s.topic,
+		Properties: props,
+		Payload:    msg.payload,
+	})
+	return err
+}
+
+func (s *mqtt5Sender) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Disconnect(ctx)
+	s.cancel()
+	s.conn = nil
+	return err
+}
+
+func mqttClientID(id string) string {
+	return fmt.Sprintf("cloudmeta-%s", id)
+}
@@ -0,0 +1,158 @@
+package background
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/types"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// startMQTTBroker runs an embedded MQTT broker and returns its address and
+// the packets published to topic.
+func startMQTTBroker(t *testing.T, topic string) (string, <-chan packets.Packet) {
+	t.Helper()
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	published := make(chan packets.Packet, 10)
+	if err := server.Subscribe(topic, 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		published <- pk
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return tcp.Address(), published
+}
+
+func receivePacket(t *testing.T, published <-chan packets.Packet) packets.Packet {
+	t.Helper()
+	select {
+	case pk := <-published:
+		return pk
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker received nothing")
+		return packets.Packet{}
+	}
+}
+
+func mqttSink(t *testing.T, scheme, addr, path string) types.URI {
+	t.Helper()
+	u := types.ParseURI(scheme + "://" + addr + path)
+	if u == nil {
+		t.Fatalf("invalid sink %s://%s%s", scheme, addr, path)
+	}
+	return *u
+}
+
+func TestMQTT3SenderPublishesStructured(t *testing.T) {
+	addr, published := startMQTTBroker(t, "events/services")
+	qos := 0
+	s, err := newMQTT3Sender("sub", mqttSink(t, "mqtt", addr, "/ignored"), &subscription.MQTT3Protocol{TopicName: "events/services", QOS: &qos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	want := testEvent()
+	if err := s.Send(ctx, binding.ToMessage(&want)); err != nil {
+		t.Fatal(err)
+	}
+
+	pk := receivePacket(t, published)
+	if pk.TopicName != "events/services" {
+		t.Errorf("got topic %q, want events/services", pk.TopicName)
+	}
+	got := cloudevents.NewEvent()
+	if err := json.Unmarshal(pk.Payload, &got); err != nil {
+		t.Fatalf("payload is not a structured event: %v: %s", err, pk.Payload)
+	}
+	if got.ID() != want.ID() || got.Type() != want.Type() || got.Subject() != want.Subject() {
+		t.Errorf("got event %s, want %s", got, want)
+	}
+	if seq, _ := types.ToString(got.Extensions()["sequence"]); seq != "2" {
+		t.Errorf("got sequence %q, want 2", seq)
+	}
+}
+
+func TestMQTT5SenderPublishesBinary(t *testing.T) {
+	addr, published := startMQTTBroker(t, "services")
+	s, err := newMQTT5Sender("sub", mqttSink(t, "tcp", addr, "/services"), &subscription.MQTT5Protocol{
+		UserProperties: map[string]string{"tenant": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	want := testEvent()
+	if err := s.Send(ctx, binding.ToMessage(&want)); err != nil {
+		t.Fatal(err)
+	}
+
+	pk := receivePacket(t, published)
+	if pk.TopicName != "services" {
+		t.Errorf("got topic %q, want the sink path services", pk.TopicName)
+	}
+	if pk.Properties.ContentType != cloudevents.ApplicationJSON {
+		t.Errorf("got content type %q, want %s", pk.Properties.ContentType, cloudevents.ApplicationJSON)
+	}
+	props := make(map[string]string)
+	for _, p := range pk.Properties.User {
+		props[p.Key] = p.Val
+	}
+	for k, v := range map[string]string{
+		"specversion": "1.0",
+		"id":          want.ID(),
+		"type":        want.Type(),
+		"source":      want.Source(),
+		"subject":     want.Subject(),
+		"sequence":    "2",
+		"tenant":      "acme",
+	} {
+		if props[k] != v {
+			t.Errorf("got user property %s %q, want %q", k, props[k], v)
+		}
+	}
+	if string(pk.Payload) != string(want.Data()) {
+		t.Errorf("got payload %s, want %s", pk.Payload, want.Data())
+	}
+}
+
+func TestMQTTSenderInvalidQoS(t *testing.T) {
+	sink := mqttSink(t, "mqtt", "127.0.0.1:1883", "/services")
+	qos := 3
+	if _, err := newMQTT3Sender("sub", sink, &subscription.MQTT3Protocol{QOS: &qos}); err == nil {
+		t.Error("MQTT3 sender accepted qos 3")
+	}
+	if _, err := newMQTT5Sender("sub", sink, &subscription.MQTT5Protocol{QOS: &qos}); err == nil {
+		t.Error("MQTT5 sender accepted qos 3")
+	}
+}
@@ -0,0 +1,94 @@
+package background
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/binding/format"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/nats-io/nats.go"
+)
+
+// Based on https://github.com/cloudevents/spec/blob/v1.0/nats-protocol-binding.md
+
+// natsSender publishes structured mode CloudEvents to a NATS subject.
+type natsSender struct {
+	url     string
+	name    string
+	subject string
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+func newNATSSender(id string, sink types.URI, settings *subscription.NATSProtocol) (*natsSender, error) {
+	if settings == nil {
+		settings = new(subscription.NATSProtocol)
+	}
+	server := sink.URL
+	subject := settings.Subject
+	if subject == "" {
+		subject = strings.TrimPrefix(server.Path, "/")
+	}
+	server.Path = ""
+
+	return &natsSender{
+		url:     server.String(),
+		name:    fmt.Sprintf("cloudmeta-%s", id),
+		subject: subject,
+	}, nil
+}
+
+// connect lazily connects, nats reconnects on its own after that.
+func (s *natsSender) connect() (*nats.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && !s.conn.IsClosed() {
+		return s.conn, nil
+	}
+	conn, err := nats.Connect(s.url, nats.Name(s.name))
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+func (s *natsSender) Send(ctx context.Context, m binding.Message, transformers ...binding.Transformer) (err error) {
+	defer func() { _ = m.Finish(err) }()
+
+	e, err := binding.ToEvent(ctx, m, transformers...)
+	if err != nil {
+		return err
+	}
+	payload, err := format.JSON.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err = conn.Publish(s.subject, payload); err != nil {
+		return err
+	}
+	// Make sure the server has the message before reporting success.
+	err = conn.FlushWithContext(ctx)
+	return err
+}
+
+func (s *natsSender) Close(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Drain()
+	s.conn = nil
+	return err
+}
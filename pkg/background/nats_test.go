@@ -0,0 +1,97 @@
+package background
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// startNATSServer runs an embedded NATS server and returns its url.
+func startNATSServer(t *testing.T) string {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	return s.ClientURL()
+}
+
+func TestNATSSenderPublishesStructured(t *testing.T) {
+	for name, tc := range map[string]struct {
+		path     string
+		settings *subscription.NATSProtocol
+	}{
+		"subject":   {path: "/ignored", settings: &subscription.NATSProtocol{Subject: "services"}},
+		"sink path": {path: "/services"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr := startNATSServer(t)
+			conn, err := nats.Connect(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			published, err := conn.SubscribeSync("services")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			sink := types.ParseURI(addr + tc.path)
+			s, err := newNATSSender("sub", *sink, tc.settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			want := testEvent()
+			if err := s.Send(ctx, binding.ToMessage(&want)); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := published.NextMsg(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := cloudevents.NewEvent()
+			if err := json.Unmarshal(msg.Data, &got); err != nil {
+				t.Fatalf("message is not a structured event: %v: %s", err, msg.Data)
+			}
+			if got.ID() != want.ID() || got.Type() != want.Type() || got.Subject() != want.Subject() {
+				t.Errorf("got event %s, want %s", got, want)
+			}
+			if string(got.Data()) != string(want.Data()) {
+				t.Errorf("got data %s, want %s", got.Data(), want.Data())
+			}
+		})
+	}
+}
+
+func TestNATSSenderUnreachable(t *testing.T) {
+	s, err := newNATSSender("sub", *types.ParseURI("nats://127.0.0.1:1/services"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testEvent()
+	if err := s.Send(context.Background(), binding.ToMessage(&e)); err == nil {
+		t.Error("send to an unreachable server succeeded")
+	}
+}
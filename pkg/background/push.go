@@ -0,0 +1,414 @@
+package background
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client"
+	"github.com/n3wscott/cloudevents-discovery/pkg/metrics"
+	"github.com/n3wscott/cloudevents-discovery/pkg/tracing"
+)
+
+// PushPath is the path the push aggregation receives downstream events on,
+// followed by the downstream's token. Serve it at PushPath+"{token}".
+const PushPath = "/aggregation/"
+
+// PushAggregation aggregates downstreams by subscribing to their service
+// events rather than polling them. Each downstream gets a subscription with
+// a sink at PushPath, and the added, updated and deleted events it delivers
+// are applied to the services manager.
+//
+// Events are numbered by the downstream, a full resync is pulled on startup,
+// when the stream (re)starts, when a number is skipped and periodically.
+// Services the downstream no longer lists are deleted on resync. While a
+// downstream can not be subscribed to it is polled instead.
+type PushAggregation struct {
+	*discoveryAggregation
+	// service is the url the downstreams reach this server at.
+	service string
+	// bearer is the token the downstreams deliver events with, if any.
+	bearer string
+	// resync is the period of full resyncs.
+	resync time.Duration
+
+	// downstreams is keyed by token.
+	downstreams map[string]*pushDownstream
+}
+
+// pushDownstream is the state of the subscription to a downstream.
+type pushDownstream struct {
+	url    url.URL
+	token  string
+	logger *zap.SugaredLogger
+	// resyncs requests a resync, with the reason.
+	resyncs chan string
+
+	// mu serializes events and resyncs, so an event that arrives during a
+	// resync is applied after it.
+	mu sync.Mutex
+	// subscribed is true while the downstream has the subscription.
+	subscribed bool
+	// started is true if the subscription was made by a resync, which covers
+	// the start of its stream.
+	started bool
+	// next is the expected sequence number of the next event, 0 if unknown.
+	next uint64
+	// known are the services last seen from the downstream, by id.
+	known map[string]discovery.Service
+	// changed are the services changed by events while a resync lists the
+	// downstream, by id, nil if deleted. The listing may predate them.
+	changed map[string]*discovery.Service
+}
+
+// NewPushAggregation aggregates the comma separated downstream urls by
+// subscribing to them. service is the url of this server as the downstreams
+// reach it, the returned aggregation must be served at service+PushPath.
+// bearer is the token the downstreams deliver events with, which this server
+// must accept, empty if it does not authenticate. opts configure the client
+// for the downstreams.
+func NewPushAggregation(service, downstream, bearer string, resync time.Duration, mgr ServicesManager, logger *zap.SugaredLogger, opts ...client.Option) *PushAggregation {
+	a := &PushAggregation{
+		discoveryAggregation: NewDiscoveryAggregation(downstream, mgr, logger, opts...).(*discoveryAggregation),
+		service:              strings.TrimSuffix(service, "/"),
+		bearer:               bearer,
+		resync:               resync,
+		downstreams:          make(map[string]*pushDownstream),
+	}
+	for _, d := range a.downstream {
+		token := newToken()
+		a.downstreams[token] = &pushDownstream{
+			url:     d,
+			token:   token,
+			logger:  logger.With("downstream", d.String()),
+			resyncs: make(chan string, 1),
+			known:   make(map[string]discovery.Service),
+		}
+	}
+	return a
+}
+
+// newToken returns a random token, which makes the sink url unguessable.
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Start subscribes to every downstream and keeps them in sync until ctx is
+// done, then deletes the subscriptions.
+func (a *PushAggregation) Start(ctx context.Context) error {
+	opts := append([]client.Option{client.WithHTTPClient(&http.Client{Transport: tracing.Transport(http.DefaultTransport)})}, a.opts...)
+	c := client.New(opts...)
+	// Subscriptions are not made conditional, a downstream that restarted
+	// has forgotten the version this client saw.
+	subs := client.New(append(opts, client.WithoutCache())...)
+
+	var wg sync.WaitGroup
+	for _, d := range a.downstreams {
+		wg.Add(1)
+		go func(d *pushDownstream) {
+			defer wg.Done()
+			a.run(ctx, c, subs, d)
+		}(d)
+	}
+	wg.Wait()
+	a.logger.Info("discovery aggregation done")
+	return ctx.Err()
+}
+
+// run resyncs the downstream on startup and when requested. While the
+// downstream is not subscribed to it is resynced every period, polling it.
+func (a *PushAggregation) run(ctx context.Context, c, subs client.Client, d *pushDownstream) {
+	poll := time.NewTicker(a.period)
+	defer poll.Stop()
+	full := time.NewTicker(a.resync)
+	defer full.Stop()
+
+	d.requestResync("startup")
+	for {
+		select {
+		case <-ctx.Done():
+			a.unsubscribe(subs, d)
+			return
+		case reason := <-d.resyncs:
+			a.sync(ctx, c, subs, d, reason)
+		case <-poll.C:
+			d.mu.Lock()
+			subscribed := d.subscribed
+			d.mu.Unlock()
+			if !subscribed {
+				a.sync(ctx, c, subs, d, "unsubscribed")
+			}
+		case <-full.C:
+			a.sync(ctx, c, subs, d, "period")
+		}
+	}
+}
+
+// requestResync asks run to resync, without blocking. A pending request
+// covers any that follow it.
+func (d *pushDownstream) requestResync(reason string) {
+	select {
+	case d.resyncs <- reason:
+	default:
+	}
+}
+
+// subscriptionID identifies this server's subscription on the downstreams.
+func (a *PushAggregation) subscriptionID() string {
+	host := "failed"
+	if u, err := url.Parse(a.service); err == nil {
+		host = strings.ReplaceAll(u.Host, ":", "")
+	}
+	return "aggregation-" + host
+}
+
+// sync makes sure the downstream has the subscription, then pulls its
+// services and deletes those it no longer lists. The downstream is only
+// locked to apply the results, events arriving meanwhile are applied as they
+// arrive and win over the listing.
+func (a *PushAggregation) sync(ctx context.Context, c, subs client.Client, d *pushDownstream, reason string) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if err := a.subscribe(ctx, subs, d); err != nil {
+		d.logger.Warnw("failed to subscribe, polling", zap.Error(err))
+	}
+
+	metrics.AggregationResyncs.WithLabelValues(d.url.String(), reason).Inc()
+	d.logger.Debugw("resyncing", "reason", reason)
+	d.mu.Lock()
+	d.changed = make(map[string]*discovery.Service)
+	d.mu.Unlock()
+	err := a.pull(ctx, c, d.url, func(ctx context.Context, svcs []discovery.Service) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		listed := make(map[string]discovery.Service, len(svcs))
+		for _, svc := range svcs {
+			if _, changed := d.changed[svc.ID]; changed {
+				continue
+			}
+			listed[svc.ID] = svc
+			a.mgr.Set(ctx, svc)
+		}
+		for id, svc := range d.changed {
+			if svc != nil {
+				listed[id] = *svc
+			}
+		}
+		for id, svc := range d.known {
+			if _, found := listed[id]; !found {
+				d.logger.Debugw("deleting service gone from downstream", "service", id)
+				a.mgr.Delete(ctx, svc)
+			}
+		}
+		d.known = listed
+		d.changed = nil
+	})
+	if err != nil {
+		d.mu.Lock()
+		d.changed = nil
+		d.mu.Unlock()
+	}
+}
+
+// subscribe creates the subscription to the service events on the
+// downstream, unless the downstream has it. A downstream that restarted
+// without persisting subscriptions has lost it.
+func (a *PushAggregation) subscribe(ctx context.Context, subs client.Client, d *pushDownstream) error {
+	sink, err := url.Parse(a.service + PushPath + d.token)
+	if err != nil {
+		return err
+	}
+	var settings *json.RawMessage
+	if a.bearer != "" {
+		raw, err := json.Marshal(subscription.HTTPProtocol{
+			Headers: map[string]string{"Authorization": "Bearer " + a.bearer},
+		})
+		if err != nil {
+			return err
+		}
+		settings = (*json.RawMessage)(&raw)
+	}
+
+	api := subs.Subscriptions(d.url).Subscriptions()
+	if sub, err := api.Get(ctx, a.subscriptionID(), nil); err == nil && sub.Sink.String() == sink.String() && a.authorizes(sub) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.subscribed = true
+		// The stream has started before, its start is not pending.
+		d.started = false
+		return nil
+	}
+
+	// The subscribed event that starts the stream may arrive before Update
+	// returns, it must find the stream started by this resync.
+	d.mu.Lock()
+	d.started = true
+	d.next = 0
+	d.mu.Unlock()
+	_, err = api.Update(ctx, subscription.Subscription{
+		ID:               a.subscriptionID(),
+		Protocol:         "HTTP",
+		Sink:             types.URI{URL: *sink},
+		ProtocolSettings: settings,
+		Filters: []subscription.FilterExpression{{
+			Prefix: map[string]string{"type": "cloudmeta.discovery.service."},
+		}},
+	}, nil)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.subscribed = false
+		d.started = false
+		return err
+	}
+	d.subscribed = true
+	d.logger.Infow("subscribed to downstream", "subscription", a.subscriptionID())
+	return nil
+}
+
+// authorizes returns true if the subscription delivers with the bearer.
+func (a *PushAggregation) authorizes(sub *subscription.Subscription) bool {
+	if a.bearer == "" {
+		return true
+	}
+	settings, err := sub.Settings()
+	if err != nil || settings.HTTPProtocol == nil {
+		return false
+	}
+	return settings.HTTPProtocol.Headers["Authorization"] == "Bearer "+a.bearer
+}
+
+// unsubscribe deletes the subscription on the downstream, best effort.
+func (a *PushAggregation) unsubscribe(subs client.Client, d *pushDownstream) {
+	d.mu.Lock()
+	subscribed := d.subscribed
+	d.mu.Unlock()
+	if !subscribed {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := subs.Subscriptions(d.url).Subscriptions().Delete(ctx, a.subscriptionID(), nil); err != nil {
+		d.logger.Warnw("failed to unsubscribe from downstream", zap.Error(err))
+		return
+	}
+	d.mu.Lock()
+	d.subscribed = false
+	d.mu.Unlock()
+}
+
+// ServeHTTP receives the events of a downstream's subscription. Events must
+// carry the bearer, if there is one.
+func (a *PushAggregation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, found := a.downstreams[strings.TrimPrefix(r.URL.Path, PushPath)]
+	if !found {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	if a.bearer != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.bearer)) != 1 {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	event, err := binding.ToEvent(r.Context(), cehttp.NewMessageFromHttpRequest(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metrics.AggregationEvents.WithLabelValues(d.url.String(), event.Type()).Inc()
+
+	ctx, span := tracing.Tracer().Start(tracing.ExtractEvent(r.Context(), *event), "aggregation.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("cloudmeta.downstream", d.url.String()),
+			attribute.String("cloudevents.event_type", event.Type()),
+		))
+	defer span.End()
+
+	var sequence uint64
+	if v, ok := event.Extensions()["sequence"]; ok {
+		s, _ := types.ToString(v)
+		sequence, _ = strconv.ParseUint(s, 10, 64)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch event.Type() {
+	case "cloudmeta.discovery.service.subscribed.v1":
+		// Events before the stream started were missed, unless the stream
+		// was started by a resync.
+		d.subscribed = true
+		d.next = sequence + 1
+		if !d.started {
+			d.requestResync("subscribed")
+		}
+		d.started = false
+
+	case "cloudmeta.discovery.service.unsubscribed.v1":
+		d.subscribed = false
+		d.next = 0
+		d.requestResync("unsubscribed")
+
+	case "cloudmeta.discovery.service.added.v1",
+		"cloudmeta.discovery.service.updated.v1",
+		"cloudmeta.discovery.service.deleted.v1":
+		if sequence != 0 {
+			// Redelivered and late events were applied or are covered by
+			// the resync their gap requested.
+			if d.next != 0 && sequence < d.next {
+				d.logger.Debugw("ignoring duplicate or late event from downstream", "expected", d.next, "sequence", sequence)
+				break
+			}
+			if d.next != 0 && sequence != d.next {
+				d.logger.Infow("missed events from downstream", "expected", d.next, "sequence", sequence)
+				d.requestResync("gap")
+			}
+			d.next = sequence + 1
+		}
+		change := ServiceChange{}
+		if err := json.Unmarshal(event.Data(), &change); err != nil {
+			http.Error(w, fmt.Sprintf("invalid service change: %v", err), http.StatusBadRequest)
+			return
+		}
+		d.logger.Debugw("service change from downstream", "change", change.Change, "service", change.Service.ID, "epoch", change.Service.Epoch)
+		if change.Change == "deleted" {
+			delete(d.known, change.Service.ID)
+			a.mgr.Delete(ctx, change.Service)
+		} else {
+			d.known[change.Service.ID] = change.Service
+			a.mgr.Set(ctx, change.Service)
+		}
+		if d.changed != nil {
+			if change.Change == "deleted" {
+				d.changed[change.Service.ID] = nil
+			} else {
+				d.changed[change.Service.ID] = &change.Service
+			}
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,280 @@
+package background
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client"
+)
+
+// downstreamVent makes the events of a downstream.
+var downstreamVent = &Vent{service: "http://downstream.test"}
+
+// changeEvent returns the event for the service change, numbered sequence
+// unless it is 0.
+func changeEvent(t *testing.T, change ServiceChange, sequence int) cloudevents.Event {
+	t.Helper()
+	e, err := downstreamVent.eventFor(change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != 0 {
+		e.SetExtension("sequence", strconv.Itoa(sequence))
+	}
+	return *e
+}
+
+// deliver sends the event to the aggregation at the token, with the
+// Authorization header if set, and returns the response status.
+func deliver(t *testing.T, a *PushAggregation, token, authorization string, e cloudevents.Event) int {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, PushPath+token, nil)
+	if err := cehttp.WriteRequest(context.Background(), binding.ToMessage(&e), r); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w.Code
+}
+
+// push delivers the service change to the aggregation as the downstream
+// would.
+func push(t *testing.T, a *PushAggregation, token string, change ServiceChange) {
+	t.Helper()
+	if got := deliver(t, a, token, "Bearer "+a.bearer, changeEvent(t, change, 0)); got != http.StatusAccepted {
+		t.Fatalf("got %d, want 202", got)
+	}
+}
+
+// newTestPushAggregation aggregates the single downstream.
+func newTestPushAggregation(t *testing.T, downstream string, resync time.Duration, mgr ServicesManager) (*PushAggregation, string, *pushDownstream) {
+	t.Helper()
+	a := NewPushAggregation("http://cloudmeta.test", downstream, "push-token", resync, mgr, zap.NewNop().Sugar())
+	for token, d := range a.downstreams {
+		return a, token, d
+	}
+	t.Fatal("no downstream")
+	return nil, "", nil
+}
+
+// resyncRequested returns the reason of the pending resync, "" if there is
+// none.
+func resyncRequested(d *pushDownstream) string {
+	select {
+	case reason := <-d.resyncs:
+		return reason
+	default:
+		return ""
+	}
+}
+
+func TestPushAggregationResync(t *testing.T) {
+	ds := newFakeDownstream(t,
+		discovery.Service{ID: "a", Name: "a", Epoch: 1},
+		discovery.Service{ID: "b", Name: "b", Epoch: 1},
+	)
+	mgr := &fakeServices{services: map[string]discovery.Service{"z": {ID: "z", Epoch: 1}}}
+	a, token, d := newTestPushAggregation(t, ds.URL, time.Hour, mgr)
+	d.known["z"] = discovery.Service{ID: "z", Epoch: 1}
+
+	synced := make(chan struct{})
+	go func() {
+		defer close(synced)
+		a.sync(context.Background(), client.New(), client.New(client.WithoutCache()), d, "test")
+	}()
+
+	// Events delivered while the services are listed are not blocked by the
+	// resync, and win over the listing.
+	<-ds.listing
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		push(t, a, token, ServiceChange{Change: "added", Service: discovery.Service{ID: "c", Name: "c", Epoch: 1}})
+		push(t, a, token, ServiceChange{Change: "deleted", Service: discovery.Service{ID: "b", Name: "b", Epoch: 1}})
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events blocked by the resync")
+	}
+	close(ds.release)
+	<-synced
+
+	if got := mgr.ids(); got != "a,c" {
+		t.Errorf("got services %s, want a,c", got)
+	}
+	if len(d.known) != 2 {
+		t.Errorf("got %d known services, want a and c", len(d.known))
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.sub == nil {
+		t.Fatal("no subscription was made")
+	}
+	if !d.subscribed || !d.started {
+		t.Errorf("got subscribed %t and started %t, want both", d.subscribed, d.started)
+	}
+	if !a.authorizes(ds.sub) {
+		t.Errorf("got protocol settings %s, want the push token", *ds.sub.ProtocolSettings)
+	}
+	want := "http://cloudmeta.test" + PushPath + token
+	if ds.sub.Sink.String() != want {
+		t.Errorf("got sink %s, want %s", ds.sub.Sink.String(), want)
+	}
+}
+
+func TestPushAggregationSequences(t *testing.T) {
+	mgr := &fakeServices{services: make(map[string]discovery.Service)}
+	a, token, d := newTestPushAggregation(t, "http://downstream.test", time.Hour, mgr)
+	service := func(id string, epoch int) discovery.Service {
+		return discovery.Service{ID: id, Name: id, Epoch: epoch}
+	}
+	subscribed := downstreamVent.subscriptionEvent("subscribed", a.subscriptionID())
+	subscribed.SetExtension("sequence", "1")
+	unsubscribed := downstreamVent.subscriptionEvent("unsubscribed", a.subscriptionID())
+
+	steps := []struct {
+		name       string
+		event      cloudevents.Event
+		wantResync string
+		wantNext   uint64
+		wantIDs    string
+	}{{
+		name:       "stream not started by a resync",
+		event:      subscribed,
+		wantResync: "subscribed",
+		wantNext:   2,
+	}, {
+		name:     "in sequence",
+		event:    changeEvent(t, ServiceChange{Change: "added", Service: service("a", 1)}, 2),
+		wantNext: 3,
+		wantIDs:  "a",
+	}, {
+		name:       "gap",
+		event:      changeEvent(t, ServiceChange{Change: "added", Service: service("b", 1)}, 5),
+		wantResync: "gap",
+		wantNext:   6,
+		wantIDs:    "a,b",
+	}, {
+		name:     "duplicate",
+		event:    changeEvent(t, ServiceChange{Change: "deleted", Service: service("b", 1)}, 5),
+		wantNext: 6,
+		wantIDs:  "a,b",
+	}, {
+		name:     "late",
+		event:    changeEvent(t, ServiceChange{Change: "added", Service: service("c", 1)}, 4),
+		wantNext: 6,
+		wantIDs:  "a,b",
+	}, {
+		name:     "unnumbered",
+		event:    changeEvent(t, ServiceChange{Change: "added", Service: service("c", 1)}, 0),
+		wantNext: 6,
+		wantIDs:  "a,b,c",
+	}, {
+		name:     "next",
+		event:    changeEvent(t, ServiceChange{Change: "updated", Service: service("a", 2)}, 6),
+		wantNext: 7,
+		wantIDs:  "a,b,c",
+	}, {
+		name:       "unsubscribed",
+		event:      unsubscribed,
+		wantResync: "unsubscribed",
+		wantIDs:    "a,b,c",
+	}, {
+		name:     "unknown sequence after the stream ended",
+		event:    changeEvent(t, ServiceChange{Change: "deleted", Service: service("c", 1)}, 3),
+		wantNext: 4,
+		wantIDs:  "a,b",
+	}}
+	for _, step := range steps {
+		if got := deliver(t, a, token, "Bearer push-token", step.event); got != http.StatusAccepted {
+			t.Fatalf("%s: got %d, want 202", step.name, got)
+		}
+		if got := resyncRequested(d); got != step.wantResync {
+			t.Errorf("%s: got resync %q, want %q", step.name, got, step.wantResync)
+		}
+		if d.next != step.wantNext {
+			t.Errorf("%s: got next %d, want %d", step.name, d.next, step.wantNext)
+		}
+		if got := mgr.ids(); got != step.wantIDs {
+			t.Errorf("%s: got services %q, want %q", step.name, got, step.wantIDs)
+		}
+	}
+
+	// A stream started by a resync does not need another.
+	d.started = true
+	if got := deliver(t, a, token, "Bearer push-token", subscribed); got != http.StatusAccepted {
+		t.Fatalf("got %d, want 202", got)
+	}
+	if got := resyncRequested(d); got != "" || d.started || !d.subscribed {
+		t.Errorf("got resync %q, started %t and subscribed %t after a resync's stream started", got, d.started, d.subscribed)
+	}
+}
+
+func TestPushAggregationRejects(t *testing.T) {
+	mgr := &fakeServices{services: make(map[string]discovery.Service)}
+	a, token, _ := newTestPushAggregation(t, "http://downstream.test", time.Hour, mgr)
+	e := changeEvent(t, ServiceChange{Change: "added", Service: discovery.Service{ID: "a", Name: "a", Epoch: 1}}, 0)
+
+	tests := map[string]struct {
+		token         string
+		authorization string
+		want          int
+	}{
+		"unknown token":  {token: "unknown", authorization: "Bearer push-token", want: http.StatusNotFound},
+		"empty token":    {authorization: "Bearer push-token", want: http.StatusNotFound},
+		"no bearer":      {token: token, want: http.StatusUnauthorized},
+		"wrong bearer":   {token: token, authorization: "Bearer other", want: http.StatusUnauthorized},
+		"bearer prefix":  {token: token, authorization: "Bearer push", want: http.StatusUnauthorized},
+		"basic":          {token: token, authorization: "Basic cHVzaC10b2tlbg==", want: http.StatusUnauthorized},
+		"correct bearer": {token: token, authorization: "Bearer push-token", want: http.StatusAccepted},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := deliver(t, a, tc.token, tc.authorization, e); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+	if got := mgr.ids(); got != "a" {
+		t.Errorf("got services %q, want only the authorized event's a", got)
+	}
+}
+
+func TestPushAggregationPeriodicResync(t *testing.T) {
+	ds := newFakeDownstream(t, discovery.Service{ID: "a", Name: "a", Epoch: 1})
+	close(ds.release)
+	mgr := &fakeServices{services: make(map[string]discovery.Service)}
+	a, _, d := newTestPushAggregation(t, ds.URL, 20*time.Millisecond, mgr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.run(ctx, client.New(client.WithoutCache()), client.New(client.WithoutCache()), d)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The downstream is subscribed to, so only the period resyncs it.
+	eventually(t, func() bool { return ds.listed() >= 3 }, "downstream listed %d times, want periodic resyncs", ds.listed())
+	if got := mgr.ids(); got != "a" {
+		t.Errorf("got services %q, want a", got)
+	}
+}
@@ -26,6 +26,10 @@ func Service(service string) discovery.Service {
 			Type:            "cloudmeta.discovery.service.subscribed.v1",
 			Description:     "Discovery - Service entry subscription start of stream.",
 			DataContentType: "application/json",
+		}, {
+			Type:            "cloudmeta.discovery.service.unsubscribed.v1",
+			Description:     "Discovery - Service entry subscription end of stream.",
+			DataContentType: "application/json",
 		}, {
 			Type:            "cloudmeta.discovery.service.added.v1",
 			Description:     "Discovery - Service entry was added.",
@@ -38,6 +42,14 @@ func Service(service string) discovery.Service {
 			Type:            "cloudmeta.discovery.service.deleted.v1",
 			Description:     "Discovery - Service entry was deleted.",
 			DataContentType: "application/json",
+		}, {
+			Type:            "cloudmeta.discovery.type.added.v1",
+			Description:     "Discovery - A service entry added an event type.",
+			DataContentType: "application/json",
+		}, {
+			Type:            "cloudmeta.discovery.type.removed.v1",
+			Description:     "Discovery - A service entry removed an event type.",
+			DataContentType: "application/json",
 		}},
 	}
 }
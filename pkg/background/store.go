@@ -0,0 +1,134 @@
+package background
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/metrics"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrStaleEpoch is returned by ServiceStore.Upsert when the stored service
+// has the same or a newer epoch than the given service.
+var ErrStaleEpoch = errors.New("service epoch is not newer than the stored epoch")
+
+// ServiceStore holds the set of known services. Implementations must be safe
+// for concurrent use.
+type ServiceStore interface {
+	// Get returns the service with the given id.
+	Get(id string) (discovery.Service, bool)
+	// List returns all services in the order they were first stored.
+	List() []discovery.Service
+	// Upsert adds the service, or replaces the stored service if the given
+	// epoch is newer. Returns ErrStaleEpoch if the service was not replaced.
+	// The change carries the span in ctx.
+	Upsert(ctx context.Context, service discovery.Service) error
+	// Delete removes the service with the given id, returning the removed
+	// service. The change carries the span in ctx.
+	Delete(ctx context.Context, id string) (discovery.Service, bool)
+	// Watch returns a channel that receives every change made to the store
+	// after the call to Watch. Watchers must drain their channel and must not
+	// call back into the store while doing so.
+	Watch() <-chan ServiceChange
+}
+
+func NewServiceStore() ServiceStore {
+	return &memoryServiceStore{
+		services: make(map[string]discovery.Service),
+		order:    make([]string, 0),
+	}
+}
+
+type memoryServiceStore struct {
+	mu       sync.RWMutex
+	services map[string]discovery.Service
+	order    []string
+
+	// notify is held while sending to watchers so changes are seen in the
+	// order they were made, without blocking readers.
+	notify   sync.Mutex
+	watchers []chan ServiceChange
+}
+
+func (s *memoryServiceStore) Get(id string) (discovery.Service, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	svc, ok := s.services[id]
+	return svc, ok
+}
+
+func (s *memoryServiceStore) List() []discovery.Service {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	services := make([]discovery.Service, 0, len(s.order))
+	for _, id := range s.order {
+		services = append(services, s.services[id])
+	}
+	return services
+}
+
+func (s *memoryServiceStore) Upsert(ctx context.Context, service discovery.Service) error {
+	s.mu.Lock()
+	change := ServiceChange{Change: "added", Service: service, SpanContext: trace.SpanContextFromContext(ctx)}
+	if old, found := s.services[service.ID]; found {
+		if service.Epoch <= old.Epoch {
+			s.mu.Unlock()
+			return ErrStaleEpoch
+		}
+		change.Change = "updated"
+		change.Previous = &old
+	} else {
+		s.order = append(s.order, service.ID)
+	}
+	s.services[service.ID] = service
+	metrics.Services.Set(float64(len(s.services)))
+	metrics.ServiceChanges.WithLabelValues(change.Change).Inc()
+
+	s.vent(change)
+	return nil
+}
+
+func (s *memoryServiceStore) Delete(ctx context.Context, id string) (discovery.Service, bool) {
+	s.mu.Lock()
+	old, found := s.services[id]
+	if !found {
+		s.mu.Unlock()
+		return old, false
+	}
+	delete(s.services, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	metrics.Services.Set(float64(len(s.services)))
+	metrics.ServiceChanges.WithLabelValues("deleted").Inc()
+
+	s.vent(ServiceChange{
+		Change:      "deleted",
+		Service:     old,
+		SpanContext: trace.SpanContextFromContext(ctx),
+	})
+	return old, true
+}
+
+func (s *memoryServiceStore) Watch() <-chan ServiceChange {
+	s.notify.Lock()
+	defer s.notify.Unlock()
+	w := make(chan ServiceChange, 10) // TODO: 10 might be too small of a channel buffer.
+	s.watchers = append(s.watchers, w)
+	return w
+}
+
+// vent must be called with s.mu held, it releases s.mu before sending.
+func (s *memoryServiceStore) vent(change ServiceChange) {
+	s.notify.Lock()
+	s.mu.Unlock()
+	defer s.notify.Unlock()
+	for _, w := range s.watchers {
+		w <- change
+	}
+}
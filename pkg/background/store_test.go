@@ -0,0 +1,138 @@
+package background
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+)
+
+func TestServiceStoreConcurrentWriters(t *testing.T) {
+	const writers, epochs = 8, 50
+	store := NewServiceStore()
+
+	// Each watcher records the changes it sees, in order.
+	watched := make([][]ServiceChange, 3)
+	var watching sync.WaitGroup
+	for i := range watched {
+		w := store.Watch()
+		watching.Add(1)
+		go func(i int) {
+			defer watching.Done()
+			for change := range w {
+				watched[i] = append(watched[i], change)
+				if len(watched[i]) == writers*(epochs+1) {
+					return
+				}
+			}
+		}(i)
+	}
+
+	var writing sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writing.Add(1)
+		go func(id string) {
+			defer writing.Done()
+			ctx := context.Background()
+			for epoch := 1; epoch <= epochs; epoch++ {
+				if err := store.Upsert(ctx, discovery.Service{ID: id, Epoch: epoch}); err != nil {
+					t.Error(err)
+				}
+				store.Get(id)
+				store.List()
+			}
+			if _, found := store.Delete(ctx, id); !found {
+				t.Errorf("service %s not found", id)
+			}
+		}(fmt.Sprintf("svc-%d", i))
+	}
+	writing.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		watching.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("watchers did not receive every change")
+	}
+
+	// Every watcher saw the same changes in the order they were made, so
+	// each service's epochs only go up and its deletion comes last.
+	for i := 1; i < len(watched); i++ {
+		if !reflect.DeepEqual(watched[i], watched[0]) {
+			t.Fatalf("watcher %d saw the changes in another order", i)
+		}
+	}
+	last := make(map[string]ServiceChange)
+	for _, change := range watched[0] {
+		prev, seen := last[change.Service.ID]
+		switch {
+		case prev.Change == "deleted":
+			t.Errorf("%s %s after it was deleted", change.Service.ID, change.Change)
+		case change.Change == "added" && seen, change.Change != "added" && !seen:
+			t.Errorf("%s %s out of order", change.Service.ID, change.Change)
+		case change.Change == "updated" && change.Service.Epoch != prev.Service.Epoch+1:
+			t.Errorf("%s updated to epoch %d after %d", change.Service.ID, change.Service.Epoch, prev.Service.Epoch)
+		}
+		last[change.Service.ID] = change
+	}
+	if len(store.List()) != 0 {
+		t.Errorf("got %d services, want every one deleted", len(store.List()))
+	}
+}
+
+func TestServiceStoreVentReleasesLock(t *testing.T) {
+	store := NewServiceStore()
+	w := store.Watch()
+
+	// Fill the watcher's buffer, so the next change blocks sending to it.
+	ctx := context.Background()
+	for len(w) < cap(w) {
+		if err := store.Upsert(ctx, discovery.Service{ID: fmt.Sprintf("svc-%d", len(w))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		if err := store.Upsert(ctx, discovery.Service{ID: "blocked"}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The blocked change is stored, and readers are not held up by it.
+	eventually(t, func() bool {
+		_, found := store.Get("blocked")
+		return found
+	}, "change was not stored")
+	read := make(chan int)
+	go func() {
+		read <- len(store.List())
+	}()
+	select {
+	case n := <-read:
+		if n != cap(w)+1 {
+			t.Errorf("listed %d services, want %d", n, cap(w)+1)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading blocked on a watcher")
+	}
+	select {
+	case <-blocked:
+		t.Fatal("change was not held up by the full watcher")
+	default:
+	}
+
+	// Draining the watcher releases the change.
+	for i := 0; i <= cap(w); i++ {
+		<-w
+	}
+	<-blocked
+}
@@ -0,0 +1,273 @@
+package background
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// SubscriptionStore holds the set of subscriptions, keyed by tenant and id.
+// Implementations must be safe for concurrent use.
+type SubscriptionStore interface {
+	// Get returns the tenant's subscription with the given id.
+	Get(tenant, id string) (subscription.Subscription, bool)
+	// List returns the tenant's subscriptions in the order they were first
+	// stored.
+	List(tenant string) []subscription.Subscription
+	// All returns the subscriptions of every tenant in the order they were
+	// first stored.
+	All() []subscription.Subscription
+	// Upsert adds or replaces the subscription, reporting if it replaced an
+	// existing subscription.
+	Upsert(sub subscription.Subscription) (bool, error)
+	// Delete removes the tenant's subscription with the given id, returning
+	// the removed subscription.
+	Delete(tenant, id string) (subscription.Subscription, bool, error)
+}
+
+// NewSubscriptionStore returns an in-memory SubscriptionStore holding subs.
+func NewSubscriptionStore(subs ...subscription.Subscription) SubscriptionStore {
+	s := &memorySubscriptionStore{
+		subscriptions: make(map[string]subscription.Subscription),
+		order:         make([]string, 0),
+	}
+	for _, sub := range subs {
+		s.put(sub)
+	}
+	return s
+}
+
+type memorySubscriptionStore struct {
+	mu sync.RWMutex
+	// subscriptions and order are keyed by subscription.Key.
+	subscriptions map[string]subscription.Subscription
+	order         []string
+}
+
+func (s *memorySubscriptionStore) Get(tenant, id string) (subscription.Subscription, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subscriptions[subscription.Key(tenant, id)]
+	return sub, ok
+}
+
+func (s *memorySubscriptionStore) List(tenant string) []subscription.Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs := make([]subscription.Subscription, 0)
+	for _, key := range s.order {
+		if sub := s.subscriptions[key]; sub.Tenant == tenant {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+func (s *memorySubscriptionStore) All() []subscription.Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs := make([]subscription.Subscription, 0, len(s.order))
+	for _, key := range s.order {
+		subs = append(subs, s.subscriptions[key])
+	}
+	return subs
+}
+
+func (s *memorySubscriptionStore) Upsert(sub subscription.Subscription) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(sub), nil
+}
+
+func (s *memorySubscriptionStore) Delete(tenant, id string) (subscription.Subscription, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, found := s.remove(subscription.Key(tenant, id))
+	return old, found, nil
+}
+
+// put must be called with s.mu held.
+func (s *memorySubscriptionStore) put(sub subscription.Subscription) bool {
+	key := sub.Key()
+	_, found := s.subscriptions[key]
+	if !found {
+		s.order = append(s.order, key)
+	}
+	s.subscriptions[key] = sub
+	return found
+}
+
+// remove must be called with s.mu held.
+func (s *memorySubscriptionStore) remove(key string) (subscription.Subscription, bool) {
+	old, found := s.subscriptions[key]
+	if !found {
+		return old, false
+	}
+	delete(s.subscriptions, key)
+	for i, o := range s.order {
+		if o == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return old, true
+}
+
+// subscriptionRecord is a single line in the file backed store's log. The
+// owner scopes of a put are recorded beside the subscription, which does not
+// serialize them.
+type subscriptionRecord struct {
+	Op           string                     `json:"op"` // "put" or "delete"
+	Tenant       string                     `json:"tenant,omitempty"`
+	ID           string                     `json:"id,omitempty"`
+	Subscription *subscription.Subscription `json:"subscription,omitempty"`
+	OwnerScopes  []string                   `json:"ownerscopes,omitempty"`
+}
+
+func putRecord(sub subscription.Subscription) subscriptionRecord {
+	return subscriptionRecord{Op: "put", Subscription: &sub, OwnerScopes: sub.OwnerScopes}
+}
+
+// NewFileSubscriptionStore returns a SubscriptionStore that persists to an
+// append-only JSON log at path. Existing subscriptions are loaded from the
+// log, which is then compacted.
+func NewFileSubscriptionStore(path string) (SubscriptionStore, error) {
+	s := &fileSubscriptionStore{
+		memorySubscriptionStore: memorySubscriptionStore{
+			subscriptions: make(map[string]subscription.Subscription),
+			order:         make([]string, 0),
+		},
+		path: path,
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type fileSubscriptionStore struct {
+	memorySubscriptionStore
+	path string
+	log  *os.File
+}
+
+func (s *fileSubscriptionStore) Upsert(sub subscription.Subscription) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(putRecord(sub)); err != nil {
+		return false, err
+	}
+	return s.put(sub), nil
+}
+
+func (s *fileSubscriptionStore) Delete(tenant, id string) (subscription.Subscription, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := subscription.Key(tenant, id)
+	if _, found := s.subscriptions[key]; !found {
+		return subscription.Subscription{}, false, nil
+	}
+	if err := s.append(subscriptionRecord{Op: "delete", Tenant: tenant, ID: id}); err != nil {
+		return subscription.Subscription{}, false, err
+	}
+	old, found := s.remove(key)
+	return old, found, nil
+}
+
+// replay loads the log into memory. A missing log is an empty store. A final
+// record that does not decode was torn by a crash while it was appended, it
+// is skipped and dropped from the log by compaction. Records that do not
+// decode anywhere else are corruption.
+func (s *fileSubscriptionStore) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	var torn error
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if torn != nil {
+			return torn
+		}
+		var rec subscriptionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			torn = fmt.Errorf("%s:%d: %v", s.path, line, err)
+			continue
+		}
+		switch rec.Op {
+		case "put":
+			if rec.Subscription == nil {
+				return fmt.Errorf("%s:%d: put without subscription", s.path, line)
+			}
+			rec.Subscription.OwnerScopes = rec.OwnerScopes
+			s.put(*rec.Subscription)
+		case "delete":
+			s.remove(subscription.Key(rec.Tenant, rec.ID))
+		default:
+			return fmt.Errorf("%s:%d: unknown op %q", s.path, line, rec.Op)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log to hold only the current subscriptions and opens
+// it for appending.
+func (s *fileSubscriptionStore) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	for _, key := range s.order {
+		if err := enc.Encode(putRecord(s.subscriptions[key])); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	s.log, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// append must be called with s.mu held.
+func (s *fileSubscriptionStore) append(rec subscriptionRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
@@ -0,0 +1,190 @@
+package background
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+// ids returns the ids of the tenant's subscriptions, in order.
+func ids(store SubscriptionStore, tenant string) []string {
+	ids := make([]string, 0)
+	for _, sub := range store.List(tenant) {
+		ids = append(ids, sub.ID)
+	}
+	return ids
+}
+
+// logLines returns the lines of the log at path.
+func logLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestFileSubscriptionStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscriptions.log")
+	store, err := NewFileSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []subscription.Subscription{
+		{ID: "a", Protocol: "HTTP", Tenant: "acme"},
+		{ID: "b", Protocol: "HTTP", Tenant: "acme"},
+		{ID: "a", Protocol: "HTTP", Tenant: "globex"},
+		{ID: "c", Protocol: "HTTP", Tenant: "acme"},
+		{ID: "a", Protocol: "KAFKA", Tenant: "acme"},
+	} {
+		if _, err := store.Upsert(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, found, err := store.Delete("acme", "b"); err != nil || !found {
+		t.Fatalf("delete: found %t, %v", found, err)
+	}
+	if got := len(logLines(t, path)); got != 6 {
+		t.Errorf("log has %d records, want 6 appended", got)
+	}
+
+	reopened, err := NewFileSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(reopened, "acme"), []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got acme subscriptions %v, want %v", got, want)
+	}
+	if got, want := ids(reopened, "globex"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got globex subscriptions %v, want %v", got, want)
+	}
+	if sub, _ := reopened.Get("acme", "a"); sub.Protocol != "KAFKA" {
+		t.Errorf("got protocol %q, want the update's KAFKA", sub.Protocol)
+	}
+
+	// Reopening compacted the log to the live subscriptions, and left no
+	// temporary files behind.
+	if got := len(logLines(t, path)); got != 3 {
+		t.Errorf("compacted log has %d records, want 3", got)
+	}
+	if files, _ := filepath.Glob(path + ".*"); len(files) != 0 {
+		t.Errorf("compaction left %v", files)
+	}
+
+	// The compacted log is appended to.
+	if _, err := reopened.Upsert(subscription.Subscription{ID: "d", Protocol: "HTTP", Tenant: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewFileSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(again, "acme"), []string{"a", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got acme subscriptions %v, want %v", got, want)
+	}
+}
+
+func TestFileSubscriptionStoreTornRecords(t *testing.T) {
+	tests := map[string]struct {
+		log     string
+		want    []string
+		wantErr bool
+	}{
+		"torn tail": {
+			log:  `{"op":"put","subscription":{"id":"a","protocol":"HTTP"}}` + "\n" + `{"op":"put","subscr`,
+			want: []string{"a"},
+		},
+		"torn tail with newline": {
+			log:  `{"op":"put","subscription":{"id":"a","protocol":"HTTP"}}` + "\n" + `{"op":"put","subscr` + "\n\n",
+			want: []string{"a"},
+		},
+		"corrupt middle": {
+			log:     `{"op":"put","subscription":{"id":"a","protocol":"HTTP"}}` + "\n" + `{"op":"put","subscr` + "\n" + `{"op":"delete","id":"a"}` + "\n",
+			wantErr: true,
+		},
+		"unknown op": {
+			log:     `{"op":"patch","id":"a"}` + "\n",
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "subscriptions.log")
+			if err := ioutil.WriteFile(path, []byte(tc.log), 0644); err != nil {
+				t.Fatal(err)
+			}
+			store, err := NewFileSubscriptionStore(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+			if err != nil {
+				// A corrupt log is left for inspection.
+				if b, _ := ioutil.ReadFile(path); string(b) != tc.log {
+					t.Errorf("corrupt log was rewritten to %q", b)
+				}
+				return
+			}
+			if got := ids(store, ""); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got subscriptions %v, want %v", got, tc.want)
+			}
+			// Compaction dropped the torn record.
+			if got := logLines(t, path); len(got) != len(tc.want) {
+				t.Errorf("got log %q, want %d records", got, len(tc.want))
+			}
+		})
+	}
+}
+
+func TestFileSubscriptionStoreMissingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscriptions.log")
+	store, err := NewFileSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store.All(); len(got) != 0 {
+		t.Errorf("got %d subscriptions, want none", len(got))
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("log not created: %v", err)
+	}
+}
+
+func TestFileSubscriptionStoreOwnerScopes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscriptions.log")
+	store, err := NewFileSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := subscription.Subscription{ID: "sub", Protocol: "HTTP", Tenant: "acme", Owner: "alice", OwnerScopes: []string{"team-a"}}
+	if _, err := store.Upsert(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scopes are internal, they only survive reopening the store.
+	b, err := json.Marshal(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "team-a") {
+		t.Errorf("subscription serializes its owner scopes: %s", b)
+	}
+
+	reopened, err := NewFileSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, found := reopened.Get("acme", "sub")
+	if !found {
+		t.Fatal("subscription not found after reopening")
+	}
+	if !reflect.DeepEqual(got.OwnerScopes, sub.OwnerScopes) {
+		t.Errorf("got owner scopes %v, want %v", got.OwnerScopes, sub.OwnerScopes)
+	}
+}
@@ -1,19 +1,35 @@
 package background
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
 	"github.com/cloudevents/sdk-go/v2/types"
 	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
 	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
-	"log"
+	"github.com/n3wscott/cloudevents-discovery/pkg/auth"
+	"github.com/n3wscott/cloudevents-discovery/pkg/cesql"
+	"github.com/n3wscott/cloudevents-discovery/pkg/jsonpath"
+	"github.com/n3wscott/cloudevents-discovery/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ServiceChange struct {
 	Change  string            `json:"change"`
 	Service discovery.Service `json:"service"`
+
+	// Previous is the replaced service for an "updated" change.
+	Previous *discovery.Service `json:"-"`
+	// SpanContext is the span that made the change, if any.
+	SpanContext trace.SpanContext `json:"-"`
 }
 
 type SubscriptionChange struct {
@@ -21,34 +37,51 @@ type SubscriptionChange struct {
 	Subscription subscription.Subscription `json:"subscription"`
 }
 
-func NewVent(service string, sinks string, changes <-chan ServiceChange, subs <-chan SubscriptionChange) Background {
-	client, err := cloudevents.NewDefaultClient()
+// NewVent vents the service and subscription changes to the subscriptions'
+// sinks and to the comma separated manual HTTP sinks. It returns an error if
+// a manual sink or the dead letter sink is invalid.
+func NewVent(service string, sinks string, delivery DeliveryConfig, changes <-chan ServiceChange, subs <-chan SubscriptionChange, logger *zap.SugaredLogger) (*Vent, error) {
+	delivery = delivery.withDefaults()
+	dl, err := newDeadLetter(delivery.DeadLetterSink, delivery.Timeout, delivery.QueueSize)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	sl := make([]subscription.Subscription, 0)
+	manual := make([]subscription.Subscription, 0)
 	for i, s := range strings.Split(sinks, ",") {
 		s = strings.TrimSpace(s)
 		if len(s) == 0 {
 			continue
 		}
-		if u := types.ParseURI(s); u != nil {
-			sl = append(sl, subscription.Subscription{
-				ID:       fmt.Sprintf("manual-entry-%d", i),
-				Protocol: "HTTP",
-				Sink:     *u,
-			})
+		u := types.ParseURI(s)
+		if u == nil {
+			return nil, fmt.Errorf("invalid sink %q", s)
 		}
+		manual = append(manual, subscription.Subscription{
+			ID:       fmt.Sprintf("manual-entry-%d", i),
+			Protocol: "HTTP",
+			Sink:     *u,
+		})
 	}
 
-	return &Vent{
-		service: service,
-		changes: changes,
-		subs:    subs,
-		client:  client,
-		sinks:   sl,
+	v := &Vent{
+		service:    service,
+		changes:    changes,
+		subs:       subs,
+		delivery:   delivery,
+		deadLetter: dl,
+		logger:     logger,
+		sinks:      make(map[string]*sink),
+		manual:     make([]*sink, 0, len(manual)),
 	}
+	for _, sub := range manual {
+		sk, err := v.newSink(sub)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %v", sub.Sink.String(), err)
+		}
+		v.manual = append(v.manual, sk)
+	}
+	return v, nil
 }
 
 type Vent struct {
@@ -56,8 +89,178 @@ type Vent struct {
 	changes <-chan ServiceChange
 	subs    <-chan SubscriptionChange
 
-	client cloudevents.Client
-	sinks  []subscription.Subscription
+	delivery   DeliveryConfig
+	deadLetter *deadLetter
+	logger     *zap.SugaredLogger
+
+	// sinks is keyed by subscription key, the tenant and id.
+	sinks map[string]*sink
+	// manual sinks are added to sinks on Start.
+	manual []*sink
+	// running counts the sinks still delivering, including stopped sinks
+	// that are draining their queue.
+	running sync.WaitGroup
+}
+
+// sink is a subscription along with its decoded protocol settings and the
+// client that delivers to it. Events are queued and delivered by run.
+type sink struct {
+	subscription.Subscription
+	settings *subscription.ProtocolSettings
+	protocol protocol.Sender
+	client   cloudevents.Client
+
+	// expression is the compiled "cesql" filter.
+	expression *cesql.Expression
+	// paths are the compiled "jsonpath" filter properties.
+	paths []*jsonpath.Path
+	// filters is the compiled subscription filters, nil if there are none.
+	filters matcher
+
+	retry retryPolicy
+	queue chan cloudevents.Event
+	// sequence is the number of the last queued event, shared with the sink
+	// this sink replaced so the stream keeps counting.
+	sequence *uint64
+	// after is closed once the sink this sink replaced has delivered its
+	// queue, delivery waits for it so events stay in order and the two never
+	// connect at once. done is closed once this sink has stopped.
+	after      <-chan struct{}
+	done       chan struct{}
+	deadLetter *deadLetter
+	// logger is tagged with the subscription id and sink.
+	logger *zap.SugaredLogger
+}
+
+// clientName names the protocol clients for the subscription, unique across
+// tenants.
+func clientName(sub subscription.Subscription) string {
+	if sub.Tenant == "" {
+		return sub.ID
+	}
+	return sub.Tenant + "-" + sub.ID
+}
+
+func (v *Vent) newSink(sub subscription.Subscription) (*sink, error) {
+	settings, err := sub.Settings()
+	if err != nil {
+		return nil, err
+	}
+
+	var p protocol.Sender
+	var retry *subscription.RetryPolicy
+	switch sub.Protocol {
+	case "HTTP":
+		p, err = newHTTPProtocol(sub.Sink, settings.HTTPProtocol)
+		retry = settings.HTTPProtocol.Retry
+	case "MQTT3":
+		p, err = newMQTT3Sender(clientName(sub), sub.Sink, settings.MQTT3Protocol)
+	case "MQTT5":
+		p, err = newMQTT5Sender(clientName(sub), sub.Sink, settings.MQTT5Protocol)
+	case "KAFKA":
+		p, err = newKafkaSender(clientName(sub), sub.Sink, settings.KafkaProtocol)
+	case "NATS":
+		p, err = newNATSSender(clientName(sub), sub.Sink, settings.NATSProtocol)
+	case "AMQP":
+		p, err = newAMQPSender(sub.Sink, settings.AMQPProtocol)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", sub.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rp, err := v.delivery.retryFor(retry)
+	if err != nil {
+		return nil, err
+	}
+
+	var expression *cesql.Expression
+	if sub.Filter != nil && sub.Filter.Dialect == "cesql" {
+		if expression, err = cesql.Parse(sub.Filter.Expression); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []*jsonpath.Path
+	if sub.Filter != nil && sub.Filter.Dialect == "jsonpath" {
+		for _, f := range sub.Filter.Filters {
+			path, err := jsonpath.Parse(f.Property)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, path)
+		}
+	}
+
+	var filters matcher
+	if len(sub.Filters) > 0 {
+		if filters, err = compileAll(sub.Filters); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := cloudevents.NewClient(p, cloudevents.WithTimeNow(), cloudevents.WithUUIDs())
+	if err != nil {
+		return nil, err
+	}
+	return &sink{
+		Subscription: sub,
+		settings:     settings,
+		protocol:     p,
+		client:       client,
+		expression:   expression,
+		paths:        paths,
+		filters:      filters,
+		retry:        rp,
+		queue:        make(chan cloudevents.Event, v.delivery.QueueSize),
+		sequence:     new(uint64),
+		done:         make(chan struct{}),
+		deadLetter:   v.deadLetter,
+		logger:       v.logger.With("subscription", sub.ID, "tenant", sub.Tenant, "sink", sub.Sink.String()),
+	}, nil
+}
+
+// filtered returns true if the event should not be sent to the sink.
+func (s *sink) filtered(event *cloudevents.Event) bool {
+	if s.filters != nil {
+		match, err := s.filters(event)
+		if err != nil {
+			s.logger.Warnw("skipping event, subscription filters failed", "type", event.Type(), zap.Error(err))
+			return true
+		}
+		if !match {
+			return true
+		}
+	}
+	if s.Filter == nil {
+		return false
+	}
+	switch s.Filter.Dialect {
+	case "basic":
+		return basicFiltered(event, s.Filter.Filters)
+	case "cesql":
+		match, err := s.expression.Match(event)
+		if err != nil {
+			s.logger.Warnw("skipping event, subscription filter failed", "type", event.Type(), zap.Error(err))
+			return true
+		}
+		return !match
+	case "jsonpath":
+		return jsonpathFiltered(event, s.Filter.Filters, s.paths)
+	}
+	s.logger.Warnw("skipping event, subscription filter dialect not supported", "dialect", s.Filter.Dialect)
+	return true
+}
+
+// canSee returns true if the subscription's owner may see the service.
+// Subscriptions without an owner were made without authentication.
+func (s *sink) canSee(service discovery.Service) bool {
+	if s.Owner == "" {
+		return true
+	}
+	owner := &auth.Principal{Name: s.Owner, Scopes: s.OwnerScopes}
+	return owner.CanSee(service.AuthScope)
 }
 
 func (v *Vent) eventFor(change ServiceChange) (*cloudevents.Event, error) {
@@ -71,75 +274,287 @@ func (v *Vent) eventFor(change ServiceChange) (*cloudevents.Event, error) {
 	return &event, nil
 }
 
+// typeEventsFor returns a type.added event for each event type the change
+// adds to the service and a type.removed event for each it removes.
+func (v *Vent) typeEventsFor(change ServiceChange) ([]cloudevents.Event, error) {
+	var added, removed []discovery.ServiceEvent
+	switch change.Change {
+	case "added":
+		added = change.Service.Events
+	case "deleted":
+		removed = change.Service.Events
+	case "updated":
+		if change.Previous == nil {
+			return nil, nil
+		}
+		added = eventsNotIn(change.Service.Events, change.Previous.Events)
+		removed = eventsNotIn(change.Previous.Events, change.Service.Events)
+	}
+
+	events := make([]cloudevents.Event, 0, len(added)+len(removed))
+	for _, e := range added {
+		event, err := v.typeEventFor("added", change.Service, e)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	for _, e := range removed {
+		event, err := v.typeEventFor("removed", change.Service, e)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	return events, nil
+}
+
+func (v *Vent) typeEventFor(change string, service discovery.Service, e discovery.ServiceEvent) (*cloudevents.Event, error) {
+	event := cloudevents.NewEvent()
+	event.SetType(fmt.Sprintf("cloudmeta.discovery.type.%s.v1", change))
+	event.SetSource(v.service)
+	event.SetSubject(fmt.Sprintf("/types/%s", e.Type))
+	if err := event.SetData(cloudevents.ApplicationJSON, discovery.TypeService{
+		ID:    service.ID,
+		URL:   service.URL,
+		Name:  service.Name,
+		Event: e,
+	}); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// eventsNotIn returns the events in a with a type that is not in b.
+func eventsNotIn(a, b []discovery.ServiceEvent) []discovery.ServiceEvent {
+	types := make(map[string]bool, len(b))
+	for _, e := range b {
+		types[e.Type] = true
+	}
+	diff := make([]discovery.ServiceEvent, 0)
+	for _, e := range a {
+		if !types[e.Type] {
+			diff = append(diff, e)
+		}
+	}
+	return diff
+}
+
+// start adds the sink and starts delivering to it, replacing any sink for
+// the same subscription. The sink delivers once the replaced sink has
+// delivered its queue.
+func (v *Vent) start(ctx context.Context, sk *sink) {
+	if old, found := v.sinks[sk.Key()]; found {
+		sk.sequence = old.sequence
+		sk.after = old.done
+		old.stop()
+	}
+	v.sinks[sk.Key()] = sk
+	v.running.Add(1)
+	go func() {
+		defer v.running.Done()
+		defer close(sk.done)
+		if sk.after != nil {
+			select {
+			case <-sk.after:
+			case <-ctx.Done():
+				return
+			}
+		}
+		sk.run(ctx)
+	}()
+}
+
+// subscribe adds a sink for the subscription and sends it the start of the
+// stream. The sink delivers once after is closed, if set.
+func (v *Vent) subscribe(ctx context.Context, sub subscription.Subscription, after <-chan struct{}) {
+	sk, err := v.newSink(sub)
+	if err != nil {
+		v.logger.Errorw("skipping subscription", "subscription", sub.ID, "tenant", sub.Tenant, zap.Error(err))
+		return
+	}
+	sk.after = after
+	v.start(ctx, sk)
+	sk.enqueue(v.subscriptionEvent("subscribed", sk.ID))
+}
+
+// unsubscribe removes the sink for the subscription key and sends it the end
+// of the stream.
+func (v *Vent) unsubscribe(key string) {
+	sk, found := v.sinks[key]
+	if !found {
+		return
+	}
+	delete(v.sinks, key)
+	sk.enqueue(v.subscriptionEvent("unsubscribed", sk.ID))
+	sk.stop()
+}
+
+func (v *Vent) subscriptionEvent(change, id string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetType(fmt.Sprintf("cloudmeta.discovery.service.%s.v1", change))
+	event.SetSource(v.service)
+	event.SetSubject("/subscriptions/" + id)
+	return event
+}
+
+// drain stops every sink and waits for their queued events, and then the
+// dead-lettered events, to be delivered, up to the drain timeout.
+func (v *Vent) drain() error {
+	for key, sk := range v.sinks {
+		delete(v.sinks, key)
+		sk.stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		v.running.Wait()
+		<-v.deadLetter.stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(v.delivery.DrainTimeout):
+		return fmt.Errorf("delivery queues not drained after %s", v.delivery.DrainTimeout)
+	}
+}
+
+// Start vents changes until ctx is done, then drains the delivery queues.
 func (v *Vent) Start(ctx context.Context) error {
+	// Deliveries outlive ctx so the queues can be drained, they are cancelled
+	// once draining is done or has timed out.
+	deliveries, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go v.deadLetter.run()
+	for _, sk := range v.manual {
+		v.start(deliveries, sk)
+	}
+
 	for {
 		select {
 		case change := <-v.subs:
-			fmt.Println("---------------------")
-			fmt.Println(change.Change, change.Subscription.Sink)
+			v.logger.Debugw("subscription change", "change", change.Change, "subscription", change.Subscription.ID, "tenant", change.Subscription.Tenant, "sink", change.Subscription.Sink.String())
 			switch change.Change {
 			case "added":
-				// TODO: we do not use the filters yet...
-				v.sinks = append(v.sinks, change.Subscription)
-
-				ctx := cloudevents.ContextWithTarget(context.Background(), change.Subscription.Sink.String())
+				v.subscribe(deliveries, change.Subscription, nil)
 
-				event := cloudevents.NewEvent()
-				event.SetType("cloudmeta.discovery.service.subscribed.v1")
-				event.SetSource(v.service)
-				event.SetSubject("/subscriptions/" + change.Subscription.ID)
-
-				if change.Subscription.Filter != nil && basicFiltered(&event, change.Subscription.Filter.Filters) {
-					continue
+			case "updated":
+				old, found := v.sinks[change.Subscription.Key()]
+				if !found {
+					v.subscribe(deliveries, change.Subscription, nil)
+					break
 				}
-				if result := v.client.Send(ctx, event); cloudevents.IsUndelivered(result) {
-					log.Println("failed to deliver event to sink: ", change.Subscription.Sink)
+				if old.Protocol != change.Subscription.Protocol || old.Sink.String() != change.Subscription.Sink.String() {
+					// Moving to a new sink ends the old stream and starts a new one.
+					v.unsubscribe(change.Subscription.Key())
+					v.subscribe(deliveries, change.Subscription, old.done)
+					break
 				}
+				sk, err := v.newSink(change.Subscription)
+				if err != nil {
+					v.logger.Errorw("skipping subscription", "subscription", change.Subscription.ID, "tenant", change.Subscription.Tenant, zap.Error(err))
+					break
+				}
+				v.start(deliveries, sk)
 
-			case "updated":
-				log.Println("todo: updated")
 			case "deleted":
-				log.Println("todo: deleted")
+				v.unsubscribe(change.Subscription.Key())
 			}
-			fmt.Println("---------------------")
 
 		case change := <-v.changes:
-			fmt.Println("service updated:", change.Change, "for", change.Service.Name)
+			v.logger.Debugw("service change", "change", change.Change, "service", change.Service.ID, "name", change.Service.Name)
+			v.ventService(change)
 
-			event, err := v.eventFor(change)
-			if err != nil {
-				log.Println("failed to create event for change: ", change)
-				continue
+		case <-ctx.Done():
+			if err := v.drain(); err != nil {
+				return err
 			}
+			return ctx.Err()
+		}
+	}
+}
 
-			for _, sink := range v.sinks {
+// ventService queues the events for the service change to every sink. The
+// events carry the trace context of a span that continues the trace of the
+// change.
+func (v *Vent) ventService(change ServiceChange) {
+	ctx := trace.ContextWithSpanContext(context.Background(), change.SpanContext)
+	ctx, span := tracing.Tracer().Start(ctx, "vent.service_change", trace.WithAttributes(
+		attribute.String("cloudmeta.change", change.Change),
+		attribute.String("cloudmeta.service.id", change.Service.ID),
+	))
+	defer span.End()
 
-				if sink.Protocol != "HTTP" {
-					log.Println("skipping: Subscription not HTTP", sink.ID)
-					continue
-				}
+	event, err := v.eventFor(change)
+	if err != nil {
+		v.logger.Errorw("failed to create event for service change", "change", change.Change, "service", change.Service.ID, zap.Error(err))
+		span.RecordError(err)
+		return
+	}
+	typeEvents, err := v.typeEventsFor(change)
+	if err != nil {
+		v.logger.Errorw("failed to create type events for service change", "change", change.Change, "service", change.Service.ID, zap.Error(err))
+		span.RecordError(err)
+		return
+	}
 
-				if sink.Filter != nil {
-					if sink.Filter.Dialect != "basic" {
-						log.Println("skipping: Subscription filter not supported, ", sink.ID, sink.Filter.Dialect)
-						continue
-					}
+	for _, e := range append([]cloudevents.Event{*event}, typeEvents...) {
+		tracing.InjectEvent(ctx, &e)
+		for _, sk := range v.sinks {
+			if sk.canSee(change.Service) {
+				sk.enqueue(e)
+			}
+		}
+	}
+}
 
-					if basicFiltered(event, sink.Filter.Filters) {
-						continue
-					}
-				}
+// jsonpathFiltered matches the basic filters against the values selected from
+// the event's JSON data by the filter's compiled path. A filter matches if any
+// selected value matches. Events without JSON data are filtered.
+func jsonpathFiltered(event *cloudevents.Event, filters []subscription.BasicFilter, paths []*jsonpath.Path) bool {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(event.Data()))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return true
+	}
 
-				ctx := cloudevents.ContextWithTarget(context.Background(), sink.Sink.String())
-				if result := v.client.Send(ctx, *event); cloudevents.IsUndelivered(result) {
-					log.Println("failed to deliver event to sink: ", sink)
-				}
+	for i, f := range filters {
+		matched := false
+		for _, v := range paths[i].Select(doc) {
+			if basicMatch(f, jsonString(v)) {
+				matched = true
+				break
 			}
-
-		case <-ctx.Done():
-			return ctx.Err()
 		}
+		if !matched {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonString returns strings as is and other JSON values in compact form.
+func jsonString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
 	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func basicMatch(f subscription.BasicFilter, value string) bool {
+	switch f.Type {
+	case "prefix":
+		return strings.HasPrefix(value, f.Value)
+	case "suffix":
+		return strings.HasSuffix(value, f.Value)
+	case "exact":
+		return value == f.Value
+	}
+	return false
 }
 
 func basicFiltered(event *cloudevents.Event, filters []subscription.BasicFilter) bool {
@@ -166,20 +581,7 @@ func basicFiltered(event *cloudevents.Event, filters []subscription.BasicFilter)
 			value, _ = types.ToString(event.Extensions()[f.Property])
 		}
 
-		switch f.Type {
-		case "prefix":
-			if !strings.HasPrefix(value, f.Value) {
-				return true
-			}
-		case "suffix":
-			if !strings.HasSuffix(value, f.Value) {
-				return true
-			}
-		case "exact":
-			if value != f.Value {
-				return true
-			}
-		default:
+		if !basicMatch(f, value) {
 			return true
 		}
 	}
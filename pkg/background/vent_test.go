@@ -0,0 +1,250 @@
+package background
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/jsonpath"
+)
+
+func TestVentHTTPMethodAndHeaders(t *testing.T) {
+	tests := map[string]struct {
+		settings   string
+		wantMethod string
+		wantHeader map[string]string
+	}{
+		"defaults": {
+			wantMethod: http.MethodPost,
+		},
+		"method": {
+			settings:   `{"method":"PUT"}`,
+			wantMethod: http.MethodPut,
+		},
+		"headers": {
+			settings:   `{"headers":{"X-Api-Key":"s3cret","X-Tenant":"acme"}}`,
+			wantMethod: http.MethodPost,
+			wantHeader: map[string]string{"X-Api-Key": "s3cret", "X-Tenant": "acme"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sink := newTestSink(t, http.StatusOK)
+			startVent(t, subscriptionTo(t, "sub", sink.URL, tc.settings))
+
+			// The start of the stream.
+			got := sink.wait(t, 1)[0]
+			if got.method != tc.wantMethod {
+				t.Errorf("got method %s, want %s", got.method, tc.wantMethod)
+			}
+			for k, v := range tc.wantHeader {
+				if got.header.Get(k) != v {
+					t.Errorf("got header %s %q, want %q", k, got.header.Get(k), v)
+				}
+			}
+		})
+	}
+}
+
+func TestVentServiceEventAttributes(t *testing.T) {
+	sink := newTestSink(t, http.StatusOK)
+	store := startVent(t, subscriptionTo(t, "sub", sink.URL, `{"method":"PUT","headers":{"X-Api-Key":"s3cret"}}`))
+	sink.wait(t, 1)
+
+	svc := discovery.Service{ID: "abc", Name: "widgets", Epoch: 3, Protocols: []string{"HTTP"}}
+	if err := store.Upsert(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+
+	got := sink.wait(t, 2)
+	subscribed, added := got[0], got[1]
+	if subscribed.event.Type() != "cloudmeta.discovery.service.subscribed.v1" {
+		t.Errorf("got first type %q, want the subscribed event", subscribed.event.Type())
+	}
+	if subscribed.event.Subject() != "/subscriptions/sub" {
+		t.Errorf("got subscribed subject %q, want /subscriptions/sub", subscribed.event.Subject())
+	}
+
+	if added.method != http.MethodPut || added.header.Get("X-Api-Key") != "s3cret" {
+		t.Errorf("got %s with X-Api-Key %q, want PUT with s3cret", added.method, added.header.Get("X-Api-Key"))
+	}
+	e := added.event
+	for attr, tc := range map[string]struct{ got, want string }{
+		"specversion":     {e.SpecVersion(), "1.0"},
+		"type":            {e.Type(), "cloudmeta.discovery.service.added.v1"},
+		"source":          {e.Source(), "http://cloudmeta.test"},
+		"subject":         {e.Subject(), "/services/abc"},
+		"datacontenttype": {e.DataContentType(), cloudevents.ApplicationJSON},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got %s %q, want %q", attr, tc.got, tc.want)
+		}
+	}
+	if e.ID() == "" || e.Time().IsZero() {
+		t.Errorf("got id %q and time %v, want both set", e.ID(), e.Time())
+	}
+	if seq, _ := types.ToString(e.Extensions()["sequence"]); seq != "2" {
+		t.Errorf("got sequence %q, want 2", seq)
+	}
+
+	change := ServiceChange{}
+	if err := json.Unmarshal(e.Data(), &change); err != nil {
+		t.Fatal(err)
+	}
+	if change.Change != "added" || change.Service.ID != "abc" || change.Service.Epoch != 3 {
+		t.Errorf("got data %+v, want the added service", change)
+	}
+}
+
+func TestJSONPathFilterServiceChanges(t *testing.T) {
+	v := &Vent{service: "http://cloudmeta.test"}
+	svc := discovery.Service{ID: "abc", Name: "widgets", Epoch: 3, Protocols: []string{"HTTP", "KAFKA"}}
+
+	tests := map[string]struct {
+		filters []subscription.BasicFilter
+		// want are the changes that pass the filters.
+		want []string
+	}{
+		"change": {
+			filters: []subscription.BasicFilter{{Type: "exact", Property: "$.change", Value: "updated"}},
+			want:    []string{"updated"},
+		},
+		"name": {
+			filters: []subscription.BasicFilter{{Type: "prefix", Property: "$.service.name", Value: "widg"}},
+			want:    []string{"added", "updated", "deleted"},
+		},
+		"any protocol": {
+			filters: []subscription.BasicFilter{{Type: "exact", Property: "$.service.protocols[*]", Value: "KAFKA"}},
+			want:    []string{"added", "updated", "deleted"},
+		},
+		"number": {
+			filters: []subscription.BasicFilter{{Type: "exact", Property: "$.service.epoch", Value: "3"}},
+			want:    []string{"added", "updated", "deleted"},
+		},
+		"all must match": {
+			filters: []subscription.BasicFilter{
+				{Type: "exact", Property: "$.service.name", Value: "widgets"},
+				{Type: "exact", Property: "$.change", Value: "deleted"},
+			},
+			want: []string{"deleted"},
+		},
+		"no match": {
+			filters: []subscription.BasicFilter{{Type: "exact", Property: "$.service.protocols[*]", Value: "AMQP"}},
+		},
+		"missing": {
+			filters: []subscription.BasicFilter{{Type: "suffix", Property: "$.service.docsurl", Value: ""}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			paths := make([]*jsonpath.Path, 0, len(tc.filters))
+			for _, f := range tc.filters {
+				p, err := jsonpath.Parse(f.Property)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, p)
+			}
+
+			var got []string
+			for _, change := range []string{"added", "updated", "deleted"} {
+				e, err := v.eventFor(ServiceChange{Change: change, Service: svc})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !jsonpathFiltered(e, tc.filters, paths) {
+					got = append(got, change)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("got %v passing, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVentTypeEvents(t *testing.T) {
+	sink := newTestSink(t, http.StatusOK)
+	store := startVent(t, subscriptionTo(t, "sub", sink.URL, ""))
+	sink.wait(t, 1)
+
+	events := func(names ...string) []discovery.ServiceEvent {
+		es := make([]discovery.ServiceEvent, 0, len(names))
+		for _, name := range names {
+			es = append(es, discovery.ServiceEvent{Type: name, Description: name + " happened"})
+		}
+		return es
+	}
+	svc := discovery.Service{ID: "abc", URL: "http://widgets.test/services/abc", Name: "widgets", Epoch: 1, Events: events("widget.created", "widget.deleted")}
+	ctx := context.Background()
+	if err := store.Upsert(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	// Replacing an event type removes the old one and adds the new one,
+	// changing only the epoch changes no types.
+	svc.Epoch = 2
+	svc.Events = events("widget.created", "widget.updated")
+	if err := store.Upsert(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	svc.Epoch = 3
+	if err := store.Upsert(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := store.Delete(ctx, svc.ID); !found {
+		t.Fatal("service not found")
+	}
+
+	type typeEvent struct{ eventType, subject, serviceEvent string }
+	want := []typeEvent{
+		{"service.added", "/services/abc", ""},
+		{"type.added", "/types/widget.created", "widget.created"},
+		{"type.added", "/types/widget.deleted", "widget.deleted"},
+		{"service.updated", "/services/abc", ""},
+		{"type.added", "/types/widget.updated", "widget.updated"},
+		{"type.removed", "/types/widget.deleted", "widget.deleted"},
+		{"service.updated", "/services/abc", ""},
+		{"service.deleted", "/services/abc", ""},
+		{"type.removed", "/types/widget.created", "widget.created"},
+		{"type.removed", "/types/widget.updated", "widget.updated"},
+	}
+	got := sink.wait(t, len(want)+1)[1:]
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		e := got[i].event
+		eventType := strings.TrimSuffix(strings.TrimPrefix(e.Type(), "cloudmeta.discovery."), ".v1")
+		if eventType != w.eventType || e.Subject() != w.subject {
+			t.Errorf("event %d: got %s %s, want %s %s", i, eventType, e.Subject(), w.eventType, w.subject)
+			continue
+		}
+		if w.serviceEvent == "" {
+			continue
+		}
+		if e.Source() != "http://cloudmeta.test" || e.DataContentType() != cloudevents.ApplicationJSON {
+			t.Errorf("event %d: got source %q and content type %q", i, e.Source(), e.DataContentType())
+		}
+		data := discovery.TypeService{}
+		if err := json.Unmarshal(e.Data(), &data); err != nil {
+			t.Fatal(err)
+		}
+		wantData := discovery.TypeService{
+			ID:    svc.ID,
+			URL:   svc.URL,
+			Name:  svc.Name,
+			Event: discovery.ServiceEvent{Type: w.serviceEvent, Description: w.serviceEvent + " happened"},
+		}
+		if fmt.Sprintf("%+v", data) != fmt.Sprintf("%+v", wantData) {
+			t.Errorf("event %d: got data %+v, want %+v", i, data, wantData)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Package cesql parses and evaluates CloudEvents SQL expressions for the
+// "cesql" subscription filter dialect, e.g.
+//
+//	type LIKE 'cloudmeta.%' AND subject = '/services/abc'
+//
+// Based on https://github.com/cloudevents/spec/tree/main/cesql
+//
+// Values are strings, 32 bit integers and booleans, arithmetic that
+// overflows 32 bits is an error. Attributes are context attributes and
+// extensions by name. A missing attribute has no value:
+// comparing it, LIKE and IN are false, and logical operators treat it as
+// false. Use EXISTS to test for an attribute.
+package cesql
+
+import (
+	"fmt"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+// Expression is a parsed CESQL expression. It is safe for concurrent use.
+type Expression struct {
+	src  string
+	root node
+}
+
+// Parse parses the expression, returning an error for invalid syntax,
+// unknown functions or the wrong number of function arguments.
+func Parse(src string) (*Expression, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, fmt.Errorf("cesql: %v", err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, fmt.Errorf("cesql: %v", err)
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("cesql: %v", p.unexpected())
+	}
+	return &Expression{src: src, root: root}, nil
+}
+
+func (x *Expression) String() string {
+	return x.src
+}
+
+// Evaluate returns the value of the expression for the event: a string, an
+// int32, a bool or nil.
+func (x *Expression) Evaluate(e *event.Event) (interface{}, error) {
+	v, err := x.root.eval(e)
+	if err != nil {
+		return nil, fmt.Errorf("cesql: %v", err)
+	}
+	return v, nil
+}
+
+// Match returns true if the expression evaluates to true for the event.
+func (x *Expression) Match(e *event.Event) (bool, error) {
+	v, err := x.Evaluate(e)
+	if err != nil || v == nil {
+		return false, err
+	}
+	b, err := toBool(v)
+	if err != nil {
+		return false, fmt.Errorf("cesql: expression must evaluate to a boolean: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,279 @@
+package cesql
+
+import (
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// testEvent has every required attribute, a subject and extensions of each
+// type. It has no time, dataschema or datacontenttype.
+func testEvent() *cloudevents.Event {
+	e := cloudevents.NewEvent()
+	e.SetID("1")
+	e.SetType("cloudmeta.discovery.service.added.v1")
+	e.SetSource("http://cloudmeta.test")
+	e.SetSubject("/services/abc")
+	e.SetExtension("count", int32(5))
+	e.SetExtension("flag", true)
+	e.SetExtension("num", "42")
+	e.SetExtension("word", "héllo")
+	return &e
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, src := range map[string]string{
+		"empty":                     ``,
+		"unterminated string":       `type = 'abc`,
+		"unterminated dquote":       `type = "abc`,
+		"escaped closing quote":     `type = 'abc\'`,
+		"doubled closing quote":     `type = 'abc''`,
+		"unopened paren":            `type = 'a')`,
+		"unclosed paren":            `(type = 'a'`,
+		"unclosed nested paren":     `((type = 'a') AND (id = '1')`,
+		"unclosed call":             `LENGTH(type`,
+		"empty in":                  `type IN ()`,
+		"not in empty":              `type NOT IN ()`,
+		"unclosed in":               `type IN ('a', 'b'`,
+		"trailing comma in":         `type IN ('a',)`,
+		"in without list":           `type IN 'a'`,
+		"like without pattern":      `type LIKE`,
+		"like integer":              `type LIKE 5`,
+		"not without like or in":    `type NOT = 'a'`,
+		"exists literal":            `EXISTS 'type'`,
+		"unknown function":          `FOO(type)`,
+		"too few arguments":         `LEFT(type)`,
+		"too many arguments":        `LENGTH(type, id)`,
+		"missing operand":           `type =`,
+		"dangling operator":         `1 +`,
+		"double comparison":         `1 = 1 = 1`,
+		"trailing tokens":           `type id`,
+		"unexpected character":      `type = 'a' & id = '1'`,
+		"integer overflow":          `2147483648`,
+		"negative integer overflow": `-2147483649`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if x, err := Parse(src); err == nil {
+				t.Errorf("parsed %q to %#v", src, x.root)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := map[string]struct {
+		src     string
+		want    interface{}
+		wantErr bool
+	}{
+		// Literals and attributes.
+		"integer":           {src: `42`, want: int32(42)},
+		"max integer":       {src: `2147483647`, want: int32(2147483647)},
+		"min integer":       {src: `-2147483648`, want: int32(-2147483648)},
+		"string":            {src: `'it''s'`, want: "it's"},
+		"escaped quote":     {src: `"say \"hi\""`, want: `say "hi"`},
+		"keywords any case": {src: `true and not False`, want: true},
+		"attribute":         {src: `type`, want: "cloudmeta.discovery.service.added.v1"},
+		"integer extension": {src: `count`, want: int32(5)},
+		"boolean extension": {src: `flag`, want: true},
+		"string extension":  {src: `num`, want: "42"},
+		"missing attribute": {src: `time`, want: nil},
+		"missing extension": {src: `nope`, want: nil},
+		"exists":            {src: `EXISTS subject`, want: true},
+		"exists missing":    {src: `EXISTS dataschema`, want: false},
+		"exists extension":  {src: `EXISTS count AND NOT EXISTS nope`, want: true},
+
+		// Precedence.
+		"multiplication first":  {src: `1 + 2 * 3`, want: int32(7)},
+		"parentheses":           {src: `(1 + 2) * 3`, want: int32(9)},
+		"left associative":      {src: `10 - 4 - 3`, want: int32(3)},
+		"division left assoc":   {src: `100 / 10 / 5`, want: int32(2)},
+		"unary minus":           {src: `-2 * 3`, want: int32(-6)},
+		"unary minus of group":  {src: `-(2 + 3)`, want: int32(-5)},
+		"double negation":       {src: `- -3`, want: int32(3)},
+		"modulo":                {src: `-7 % 3`, want: int32(-1)},
+		"arithmetic in compare": {src: `1 + 1 = 2`, want: true},
+		"and before or":         {src: `TRUE OR FALSE AND FALSE`, want: true},
+		"and before xor":        {src: `FALSE AND FALSE XOR TRUE`, want: true},
+		"xor before or":         {src: `TRUE XOR TRUE OR TRUE`, want: true},
+		"or last":               {src: `FALSE OR TRUE XOR TRUE`, want: false},
+		"not after compare":     {src: `NOT TRUE = FALSE`, want: true},
+		"not before and":        {src: `NOT FALSE AND FALSE`, want: false},
+		"double not":            {src: `NOT NOT TRUE`, want: true},
+		"not of group":          {src: `NOT (TRUE AND FALSE)`, want: true},
+
+		// Comparisons.
+		"equal":               {src: `id = '1'`, want: true},
+		"not equal":           {src: `id != '1'`, want: false},
+		"not equal sql":       {src: `id <> '2'`, want: true},
+		"less":                {src: `count < 6`, want: true},
+		"less or equal":       {src: `count <= 5`, want: true},
+		"greater":             {src: `count > 5`, want: false},
+		"greater or equal":    {src: `count >= 5`, want: true},
+		"order of word":       {src: `'abc' < 10`, wantErr: true},
+		"case sensitive":      {src: `type = 'CLOUDMETA.discovery.service.added.v1'`, want: false},
+		"compare missing":     {src: `nope = 'x'`, want: false},
+		"compare missing not": {src: `nope != 'x'`, want: false},
+		"not compare missing": {src: `NOT (nope = 'x')`, want: true},
+		"order missing":       {src: `nope < 1`, want: false},
+		"missing or":          {src: `nope OR TRUE`, want: true},
+		"missing and":         {src: `nope AND TRUE`, want: false},
+		"missing arithmetic":  {src: `nope + 1`, want: nil},
+		"not missing":         {src: `NOT nope`, want: nil},
+
+		// LIKE.
+		"like percent":           {src: `type LIKE 'cloudmeta.%'`, want: true},
+		"like percent inside":    {src: `type LIKE '%.service.%'`, want: true},
+		"like percent empty":     {src: `'abc' LIKE 'abc%'`, want: true},
+		"like underscore":        {src: `'abc' LIKE 'a_c'`, want: true},
+		"like underscore one":    {src: `'abbc' LIKE 'a_c'`, want: false},
+		"like underscore none":   {src: `'ac' LIKE 'a_c'`, want: false},
+		"like whole value":       {src: `'abc' LIKE 'b'`, want: false},
+		"like escaped percent":   {src: `'a%c' LIKE 'a\%c'`, want: true},
+		"like escaped percent x": {src: `'abc' LIKE 'a\%c'`, want: false},
+		"like escaped under":     {src: `'a_c' LIKE 'a\_c'`, want: true},
+		"like escaped under x":   {src: `'abc' LIKE 'a\_c'`, want: false},
+		"like escaped backslash": {src: `'a\c' LIKE 'a\\c'`, want: true},
+		"like regexp literal":    {src: `'abc' LIKE 'a.c'`, want: false},
+		"like dot":               {src: `'a.c' LIKE 'a.c'`, want: true},
+		"like case sensitive":    {src: `'ABC' LIKE 'abc'`, want: false},
+		"like unicode":           {src: `word LIKE 'h_llo'`, want: true},
+		"like integer":           {src: `count LIKE '5'`, want: true},
+		"not like":               {src: `type NOT LIKE 'com.%'`, want: true},
+		"like missing":           {src: `nope LIKE '%'`, want: false},
+		"not like missing":       {src: `nope NOT LIKE 'x'`, want: false},
+
+		// IN.
+		"in":             {src: `id IN ('2', '1')`, want: true},
+		"in none":        {src: `id IN ('2', '3')`, want: false},
+		"not in":         {src: `id NOT IN ('2', '3')`, want: true},
+		"in cast":        {src: `count IN ('4', '5')`, want: true},
+		"in expressions": {src: `count IN (2 + 3)`, want: true},
+		"in missing":     {src: `nope IN ('x')`, want: false},
+		"in skip nil":    {src: `id IN (nope, '1')`, want: true},
+
+		// Casts.
+		"int of string":         {src: `INT(' 42 ')`, want: int32(42)},
+		"int of int":            {src: `INT(count)`, want: int32(5)},
+		"int of word":           {src: `INT('x')`, wantErr: true},
+		"int of bool":           {src: `INT(TRUE)`, wantErr: true},
+		"int out of range":      {src: `INT('2147483648')`, wantErr: true},
+		"bool of string":        {src: `BOOL('TRUE')`, want: true},
+		"bool of false":         {src: `BOOL('false')`, want: false},
+		"bool of word":          {src: `BOOL('x')`, wantErr: true},
+		"bool of int":           {src: `BOOL(1)`, wantErr: true},
+		"string of int":         {src: `STRING(-5)`, want: "-5"},
+		"string of bool":        {src: `STRING(flag)`, want: "true"},
+		"implicit int compare":  {src: `num > 41`, want: true},
+		"implicit int equal":    {src: `count = '5'`, want: true},
+		"implicit string equal": {src: `num = 42`, want: true},
+		"implicit bool equal":   {src: `flag = 'true'`, want: true},
+		"implicit bad int":      {src: `type < 5`, wantErr: true},
+		"implicit bad bool":     {src: `flag = 'yes'`, wantErr: true},
+		"implicit int arith":    {src: `num + 1`, want: int32(43)},
+		"implicit bad arith":    {src: `type + 1`, wantErr: true},
+		"implicit bool logic":   {src: `'true' AND 'TRUE'`, want: true},
+		"implicit bad logic":    {src: `type AND TRUE`, wantErr: true},
+		"is int":                {src: `IS_INT(num) AND NOT IS_INT(type)`, want: true},
+		"is int missing":        {src: `IS_INT(nope)`, want: false},
+		"is bool":               {src: `IS_BOOL('False') AND NOT IS_BOOL(count)`, want: true},
+
+		// Integer overflow.
+		"add overflow":      {src: `2147483647 + 1`, wantErr: true},
+		"subtract overflow": {src: `-2147483648 - 1`, wantErr: true},
+		"multiply overflow": {src: `65536 * 65536`, wantErr: true},
+		"divide overflow":   {src: `-2147483648 / -1`, wantErr: true},
+		"negate overflow":   {src: `-(-2147483648)`, wantErr: true},
+		"abs overflow":      {src: `ABS(-2147483648)`, wantErr: true},
+		"no overflow":       {src: `2147483647 - 1 + 1`, want: int32(2147483647)},
+		"division by zero":  {src: `1 / 0`, wantErr: true},
+		"modulo by zero":    {src: `1 % 0`, wantErr: true},
+
+		// Functions.
+		"length":              {src: `LENGTH(word)`, want: int32(5)},
+		"length of int":       {src: `LENGTH(-12)`, want: int32(3)},
+		"length missing":      {src: `LENGTH(nope)`, want: nil},
+		"concat":              {src: `CONCAT(id, '-', count)`, want: "1-5"},
+		"concat nothing":      {src: `CONCAT()`, want: ""},
+		"concat missing":      {src: `CONCAT(id, nope)`, want: nil},
+		"concat_ws":           {src: `CONCAT_WS('/', 'a', 'b', 'c')`, want: "a/b/c"},
+		"lower":               {src: `LOWER('AbC')`, want: "abc"},
+		"upper":               {src: `UPPER(word)`, want: "HÉLLO"},
+		"trim":                {src: `TRIM('  a b ')`, want: "a b"},
+		"abs":                 {src: `ABS(-3)`, want: int32(3)},
+		"left":                {src: `LEFT('hello', 2)`, want: "he"},
+		"left unicode":        {src: `LEFT(word, 2)`, want: "hé"},
+		"left zero":           {src: `LEFT('hello', 0)`, want: ""},
+		"left beyond":         {src: `LEFT('hello', 10)`, want: "hello"},
+		"left negative":       {src: `LEFT('hello', -1)`, wantErr: true},
+		"left bad length":     {src: `LEFT('hello', 'x')`, wantErr: true},
+		"right":               {src: `RIGHT('hello', 2)`, want: "lo"},
+		"right beyond":        {src: `RIGHT('hello', 10)`, want: "hello"},
+		"right negative":      {src: `RIGHT('hello', -1)`, wantErr: true},
+		"substring":           {src: `SUBSTRING('hello', 2)`, want: "ello"},
+		"substring first":     {src: `SUBSTRING('hello', 1)`, want: "hello"},
+		"substring last":      {src: `SUBSTRING('hello', 5)`, want: "o"},
+		"substring end":       {src: `SUBSTRING('hello', 6)`, want: ""},
+		"substring beyond":    {src: `SUBSTRING('hello', 7)`, wantErr: true},
+		"substring zero":      {src: `SUBSTRING('hello', 0)`, wantErr: true},
+		"substring negative":  {src: `SUBSTRING('hello', -2)`, want: "lo"},
+		"substring neg first": {src: `SUBSTRING('hello', -5)`, want: "hello"},
+		"substring neg out":   {src: `SUBSTRING('hello', -6)`, wantErr: true},
+		"substring length":    {src: `SUBSTRING('hello', 2, 3)`, want: "ell"},
+		"substring zero len":  {src: `SUBSTRING('hello', 2, 0)`, want: ""},
+		"substring long len":  {src: `SUBSTRING('hello', 2, 10)`, want: "ello"},
+		"substring neg len":   {src: `SUBSTRING('hello', 2, -1)`, wantErr: true},
+		"substring unicode":   {src: `SUBSTRING(word, 2, 1)`, want: "é"},
+		"substring of int":    {src: `SUBSTRING(12345, -2)`, want: "45"},
+		"function any case":   {src: `lower(UPPER('a'))`, want: "a"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			x, err := Parse(tc.src)
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatal(err)
+				}
+				return
+			}
+			got, err := x.Evaluate(testEvent())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("%s: got %v, %v, want error %t", tc.src, got, err, tc.wantErr)
+			}
+			if err == nil && got != tc.want {
+				t.Errorf("%s: got %#v, want %#v", tc.src, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := map[string]struct {
+		src     string
+		want    bool
+		wantErr bool
+	}{
+		"true":           {src: `type LIKE 'cloudmeta.%' AND subject = '/services/abc'`, want: true},
+		"false":          {src: `subject = '/services/def'`},
+		"missing":        {src: `nope + 1 = 2`},
+		"missing value":  {src: `nope`},
+		"boolean string": {src: `'TRUE'`, want: true},
+		"not a boolean":  {src: `LENGTH(type)`, wantErr: true},
+		"eval error":     {src: `INT(type) = 1`, wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			x, err := Parse(tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := x.Match(testEvent())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package cesql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/cloudevents/sdk-go/v2/types"
+)
+
+// Values are string, int32 or bool. A missing attribute is nil.
+
+// node is a node of the parsed expression.
+type node interface {
+	eval(e *event.Event) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(*event.Event) (interface{}, error) {
+	return n.value, nil
+}
+
+type attributeNode struct {
+	name string
+}
+
+func (n *attributeNode) eval(e *event.Event) (interface{}, error) {
+	v, _ := attribute(e, n.name)
+	return v, nil
+}
+
+type existsNode struct {
+	name string
+}
+
+func (n *existsNode) eval(e *event.Event) (interface{}, error) {
+	_, ok := attribute(e, n.name)
+	return ok, nil
+}
+
+// attribute returns the value of the context attribute or extension.
+// Integer and boolean extensions keep their type, everything else is a
+// string.
+func attribute(e *event.Event, name string) (interface{}, bool) {
+	switch name {
+	case "specversion":
+		return e.SpecVersion(), true
+	case "type":
+		return e.Type(), true
+	case "source":
+		return e.Source(), true
+	case "id":
+		return e.ID(), true
+	case "subject":
+		return e.Subject(), e.Subject() != ""
+	case "time":
+		if e.Time().IsZero() {
+			return nil, false
+		}
+		v, _ := types.ToString(e.Time())
+		return v, true
+	case "dataschema":
+		return e.DataSchema(), e.DataSchema() != ""
+	case "datacontenttype":
+		return e.DataContentType(), e.DataContentType() != ""
+	}
+
+	ext, ok := e.Extensions()[name]
+	if !ok {
+		return nil, false
+	}
+	switch v := ext.(type) {
+	case int32, bool:
+		return v, true
+	}
+	v, err := types.ToString(ext)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+type notNode struct {
+	x node
+}
+
+func (n *notNode) eval(e *event.Event) (interface{}, error) {
+	v, err := n.x.eval(e)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	b, err := toBool(v)
+	if err != nil {
+		return nil, err
+	}
+	return !b, nil
+}
+
+type negateNode struct {
+	x node
+}
+
+func (n *negateNode) eval(e *event.Event) (interface{}, error) {
+	v, err := n.x.eval(e)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	i, err := toInt(v)
+	if err != nil {
+		return nil, err
+	}
+	return checked(-int64(i))
+}
+
+type logicNode struct {
+	op          string
+	left, right node
+}
+
+// eval treats nil as false and short circuits AND and OR.
+func (n *logicNode) eval(e *event.Event) (interface{}, error) {
+	left, err := evalBool(n.left, e)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case n.op == "AND" && !left:
+		return false, nil
+	case n.op == "OR" && left:
+		return true, nil
+	}
+	right, err := evalBool(n.right, e)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "XOR" {
+		return left != right, nil
+	}
+	return right, nil
+}
+
+func evalBool(n node, e *event.Event) (bool, error) {
+	v, err := n.eval(e)
+	if err != nil || v == nil {
+		return false, err
+	}
+	return toBool(v)
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+// eval compares the operands after casting the right operand to the type of
+// the left. Comparisons with a missing attribute are false.
+func (n *compareNode) eval(e *event.Event) (interface{}, error) {
+	left, err := n.left.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	switch n.op {
+	case "=", "!=":
+		eq, err := equal(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return eq == (n.op == "="), nil
+	}
+
+	l, err := toInt(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := toInt(right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	default: // ">="
+		return l >= r, nil
+	}
+}
+
+func equal(left, right interface{}) (bool, error) {
+	switch l := left.(type) {
+	case bool:
+		r, err := toBool(right)
+		return l == r, err
+	case int32:
+		r, err := toInt(right)
+		return l == r, err
+	default:
+		return left.(string) == toString(right), nil
+	}
+}
+
+type arithmeticNode struct {
+	op          string
+	left, right node
+}
+
+func (n *arithmeticNode) eval(e *event.Event) (interface{}, error) {
+	left, err := n.left.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	l, err := toInt(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := toInt(right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "+":
+		return checked(int64(l) + int64(r))
+	case "-":
+		return checked(int64(l) - int64(r))
+	case "*":
+		return checked(int64(l) * int64(r))
+	}
+	if r == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	if n.op == "/" {
+		return checked(int64(l) / int64(r))
+	}
+	return checked(int64(l) % int64(r))
+}
+
+// checked returns the result of integer arithmetic, an error if it
+// overflows 32 bits.
+func checked(i int64) (interface{}, error) {
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		return nil, fmt.Errorf("integer overflow")
+	}
+	return int32(i), nil
+}
+
+type likeNode struct {
+	x       node
+	pattern *regexp.Regexp
+	not     bool
+}
+
+func (n *likeNode) eval(e *event.Event) (interface{}, error) {
+	v, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return false, nil
+	}
+	return n.pattern.MatchString(toString(v)) != n.not, nil
+}
+
+type inNode struct {
+	x   node
+	set []node
+	not bool
+}
+
+func (n *inNode) eval(e *event.Event) (interface{}, error) {
+	v, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return false, nil
+	}
+	for _, s := range n.set {
+		sv, err := s.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		if sv == nil {
+			continue
+		}
+		eq, err := equal(v, sv)
+		if err != nil {
+			return nil, err
+		}
+		if eq {
+			return !n.not, nil
+		}
+	}
+	return n.not, nil
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(e *event.Event) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args))
+	for _, a := range n.args {
+		v, err := a.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil && !n.fn.nullable {
+			return nil, nil
+		}
+		args = append(args, v)
+	}
+	v, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return v, nil
+}
+
+// -- casting --
+
+func toBool(v interface{}) (bool, error) {
+	switch b := v.(type) {
+	case bool:
+		return b, nil
+	case string:
+		switch strings.ToLower(b) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("cannot cast %v to a boolean", quote(v))
+}
+
+func toInt(v interface{}) (int32, error) {
+	switch i := v.(type) {
+	case int32:
+		return i, nil
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(i), 10, 32); err == nil {
+			return int32(n), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot cast %v to an integer", quote(v))
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case int32:
+		return strconv.FormatInt(int64(s), 10)
+	case bool:
+		return strconv.FormatBool(s)
+	}
+	return fmt.Sprint(v)
+}
+
+func quote(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("'%s'", s)
+	}
+	return toString(v)
+}
@@ -0,0 +1,136 @@
+package cesql
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// function is a built-in function. Unless nullable, the function is not
+// called and evaluates to nil if an argument is nil.
+type function struct {
+	minArgs  int
+	maxArgs  int // -1 for variadic
+	nullable bool
+	call     func(args []interface{}) (interface{}, error)
+}
+
+var functions = map[string]function{
+	"LENGTH": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return int32(utf8.RuneCountInString(toString(args[0]))), nil
+	}},
+	"CONCAT": {minArgs: 0, maxArgs: -1, call: func(args []interface{}) (interface{}, error) {
+		return strings.Join(toStrings(args), ""), nil
+	}},
+	"CONCAT_WS": {minArgs: 1, maxArgs: -1, call: func(args []interface{}) (interface{}, error) {
+		return strings.Join(toStrings(args[1:]), toString(args[0])), nil
+	}},
+	"LOWER": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(toString(args[0])), nil
+	}},
+	"UPPER": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(args[0])), nil
+	}},
+	"TRIM": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return strings.TrimSpace(toString(args[0])), nil
+	}},
+	"LEFT": {minArgs: 2, maxArgs: 2, call: func(args []interface{}) (interface{}, error) {
+		s := []rune(toString(args[0]))
+		n, err := toInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("negative length %d", n)
+		}
+		if int(n) < len(s) {
+			s = s[:n]
+		}
+		return string(s), nil
+	}},
+	"RIGHT": {minArgs: 2, maxArgs: 2, call: func(args []interface{}) (interface{}, error) {
+		s := []rune(toString(args[0]))
+		n, err := toInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("negative length %d", n)
+		}
+		if int(n) < len(s) {
+			s = s[len(s)-int(n):]
+		}
+		return string(s), nil
+	}},
+	// SUBSTRING(s, pos[, len]) where pos is 1 based, or counts from the end
+	// if negative.
+	"SUBSTRING": {minArgs: 2, maxArgs: 3, call: func(args []interface{}) (interface{}, error) {
+		s := []rune(toString(args[0]))
+		pos, err := toInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		start := int(pos) - 1
+		if pos < 0 {
+			start = len(s) + int(pos)
+		}
+		if start < 0 || start > len(s) || pos == 0 {
+			return nil, fmt.Errorf("position %d out of range", pos)
+		}
+		end := len(s)
+		if len(args) == 3 {
+			n, err := toInt(args[2])
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("negative length %d", n)
+			}
+			if start+int(n) < end {
+				end = start + int(n)
+			}
+		}
+		return string(s[start:end]), nil
+	}},
+	"ABS": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		i, err := toInt(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			return checked(-int64(i))
+		}
+		return i, nil
+	}},
+	"INT": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return toInt(args[0])
+	}},
+	"BOOL": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return toBool(args[0])
+	}},
+	"STRING": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return toString(args[0]), nil
+	}},
+	"IS_INT": {minArgs: 1, maxArgs: 1, nullable: true, call: func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return false, nil
+		}
+		_, err := toInt(args[0])
+		return err == nil, nil
+	}},
+	"IS_BOOL": {minArgs: 1, maxArgs: 1, nullable: true, call: func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return false, nil
+		}
+		_, err := toBool(args[0])
+		return err == nil, nil
+	}},
+}
+
+func toStrings(args []interface{}) []string {
+	s := make([]string, 0, len(args))
+	for _, a := range args {
+		s = append(s, toString(a))
+	}
+	return s
+}
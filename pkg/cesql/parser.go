@@ -0,0 +1,327 @@
+package cesql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// parser is a recursive descent parser. From lowest to highest precedence:
+//
+//	OR
+//	XOR
+//	AND
+//	NOT
+//	=, !=, <>, <, <=, >, >=, [NOT] LIKE, [NOT] IN
+//	+, -
+//	*, /, %
+//	unary -
+//	literals, attributes, EXISTS, function calls and parentheses
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the keyword or operator.
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if t := p.peek(); t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	return fmt.Errorf("position %d: unexpected %s", t.pos, t)
+}
+
+func (p *parser) parseExpression() (node, error) {
+	return p.parseLogic(0)
+}
+
+// logicLevels are the logical operators, from lowest precedence.
+var logicLevels = []string{"OR", "XOR", "AND"}
+
+func (p *parser) parseLogic(level int) (node, error) {
+	if level == len(logicLevels) {
+		return p.parseNot()
+	}
+	left, err := p.parseLogic(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokKeyword, logicLevels[level]) {
+		right, err := p.parseLogic(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{op: logicLevels[level], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept(tokKeyword, "NOT") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && isComparison(t.text):
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "<>" {
+			op = "!="
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+
+	case t.kind == tokKeyword && (t.text == "NOT" || t.text == "LIKE" || t.text == "IN"):
+		not := p.accept(tokKeyword, "NOT")
+		if p.accept(tokKeyword, "LIKE") {
+			return p.parseLike(left, not)
+		}
+		if p.accept(tokKeyword, "IN") {
+			return p.parseIn(left, not)
+		}
+		return nil, p.unexpected()
+	}
+	return left, nil
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "=", "!=", "<>", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseLike(x node, not bool) (node, error) {
+	t := p.next()
+	if t.kind != tokString {
+		return nil, fmt.Errorf("position %d: LIKE expects a string pattern, got %s", t.pos, t)
+	}
+	re, err := likePattern(t.text)
+	if err != nil {
+		return nil, fmt.Errorf("position %d: %v", t.pos, err)
+	}
+	return &likeNode{x: x, pattern: re, not: not}, nil
+}
+
+// likePattern compiles a LIKE pattern, where % matches any sequence of
+// characters and _ matches a single character. Either can be escaped with \.
+func likePattern(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '\\':
+			if i+1 == len(pattern) {
+				return nil, fmt.Errorf("LIKE pattern %q ends with an escape", pattern)
+			}
+			i++
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func (p *parser) parseIn(x node, not bool) (node, error) {
+	if err := p.expect(tokLParen, "("); err != nil {
+		return nil, err
+	}
+	set, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("position %d: IN expects at least one value", p.peek().pos)
+	}
+	return &inNode{x: x, set: set, not: not}, nil
+}
+
+// parseList parses a comma separated list of expressions, the opening
+// parenthesis has already been consumed.
+func (p *parser) parseList() ([]node, error) {
+	list := make([]node, 0)
+	if p.accept(tokRParen, ")") {
+		return list, nil
+	}
+	for {
+		n, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+		if p.accept(tokRParen, ")") {
+			return list, nil
+		}
+		if err := p.expect(tokComma, ","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "+" && t.text != "-") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept(tokOp, "-") {
+		// Fold negative literals so the minimum integer can be written.
+		if t := p.peek(); t.kind == tokInt {
+			p.next()
+			return parseInt(t, "-")
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateNode{x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt:
+		return parseInt(t, "")
+
+	case tokString:
+		return &literalNode{value: t.text}, nil
+
+	case tokKeyword:
+		switch t.text {
+		case "TRUE":
+			return &literalNode{value: true}, nil
+		case "FALSE":
+			return &literalNode{value: false}, nil
+		case "EXISTS":
+			a := p.next()
+			if a.kind != tokIdent {
+				return nil, fmt.Errorf("position %d: EXISTS expects an attribute, got %s", a.pos, a)
+			}
+			return &existsNode{name: a.text}, nil
+		}
+
+	case tokIdent:
+		if p.accept(tokLParen, "(") {
+			return p.parseCall(t)
+		}
+		return &attributeNode{name: t.text}, nil
+
+	case tokLParen:
+		x, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	return nil, fmt.Errorf("position %d: unexpected %s", t.pos, t)
+}
+
+func parseInt(t token, sign string) (node, error) {
+	i, err := strconv.ParseInt(sign+t.text, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("position %d: integer %s%s out of range", t.pos, sign, t.text)
+	}
+	return &literalNode{value: int32(i)}, nil
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[strings.ToUpper(name.text)]
+	if !ok {
+		return nil, fmt.Errorf("position %d: unknown function %s", name.pos, name.text)
+	}
+	args, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, fmt.Errorf("position %d: wrong number of arguments for %s, got %d", name.pos, strings.ToUpper(name.text), len(args))
+	}
+	return &callNode{name: strings.ToUpper(name.text), fn: fn, args: args}, nil
+}
@@ -0,0 +1,77 @@
+// Package cache holds the entity tags and decoded bodies of a client's GET
+// responses, so requests can be made conditional and a 304 Not Modified
+// answered from the cache without decoding the body again.
+package cache
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Entry is a cached response.
+type Entry struct {
+	// ETag is the response's entity tag, sent as If-None-Match to revalidate
+	// and If-Match to change the resource.
+	ETag string
+	// Value is the decoded body.
+	Value interface{}
+	// Header holds the response headers.
+	Header http.Header
+}
+
+// Cache holds entries keyed by request url. A nil Cache holds nothing. Safe
+// for concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func New() *Cache {
+	return &Cache{entries: make(map[string]Entry)}
+}
+
+// Get returns the entry for the url.
+func (c *Cache) Get(url string) (Entry, bool) {
+	if c == nil {
+		return Entry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	return e, ok
+}
+
+// Put stores the entry for the url, entries without an ETag are not stored.
+func (c *Cache) Put(url string, e Entry) {
+	if c == nil || e.ETag == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[url] = e
+}
+
+// Delete removes the entry for the url.
+func (c *Cache) Delete(url string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, url)
+}
+
+// Revalidate sets If-None-Match on the GET request if its url is cached.
+func (c *Cache) Revalidate(req *http.Request) {
+	if e, ok := c.Get(req.URL.String()); ok {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+}
+
+// Precondition sets If-Match on the request to the entity tag cached for
+// url, the last seen version of the resource the request changes.
+func (c *Cache) Precondition(req *http.Request, url string) {
+	if e, ok := c.Get(url); ok {
+		req.Header.Set("If-Match", e.ETag)
+	}
+}
@@ -1,8 +1,11 @@
 package client
 
 import (
+	"crypto/tls"
+	"net/http"
 	"net/url"
 
+	"github.com/n3wscott/cloudevents-discovery/pkg/client/cache"
 	"github.com/n3wscott/cloudevents-discovery/pkg/client/discovery"
 	"github.com/n3wscott/cloudevents-discovery/pkg/client/subscription"
 )
@@ -12,18 +15,108 @@ type Client interface {
 	Discovery(baseURL url.URL) discovery.DiscoveryAPI
 }
 
-func New() Client {
-	return &client{}
+// Option configures a Client.
+type Option func(*client)
+
+// WithHTTPClient sets the http client used for requests, http.DefaultClient
+// by default.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *client) {
+		c.http = hc
+	}
+}
+
+// WithBearerToken authenticates requests with the token, a static token or a
+// JWT.
+func WithBearerToken(token string) Option {
+	return func(c *client) {
+		c.token = token
+	}
+}
+
+// WithTLSConfig sets the TLS config for requests, holding the client
+// certificate to authenticate with and the CAs to trust. It applies to the
+// http client's transport if that is unset or an *http.Transport, other
+// transports must be configured directly.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *client) {
+		c.tls = cfg
+	}
+}
+
+// WithoutCache disables the response cache. By default responses are cached
+// by entity tag, GETs revalidate with If-None-Match and updates and deletes
+// are conditional with If-Match on the last seen version.
+func WithoutCache() Option {
+	return func(c *client) {
+		c.cache = nil
+	}
+}
+
+func New(opts ...Option) Client {
+	c := &client{http: http.DefaultClient, cache: cache.New()}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.http = c.authorized()
+	return c
 }
 
 type client struct {
-	// TODO: this will hold http clients and auth and stuff.
+	http  *http.Client
+	cache *cache.Cache
+
+	// Credentials, added to http by authorized.
+	token string
+	tls   *tls.Config
+}
+
+// authorized returns a copy of the http client that presents the client's
+// credentials.
+func (c *client) authorized() *http.Client {
+	if c.token == "" && c.tls == nil {
+		return c.http
+	}
+	hc := *c.http
+	if c.tls != nil {
+		switch t := hc.Transport.(type) {
+		case nil:
+			tr := http.DefaultTransport.(*http.Transport).Clone()
+			tr.TLSClientConfig = c.tls
+			hc.Transport = tr
+		case *http.Transport:
+			tr := t.Clone()
+			tr.TLSClientConfig = c.tls
+			hc.Transport = tr
+		}
+	}
+	if c.token != "" {
+		base := hc.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		hc.Transport = &bearerTransport{token: c.token, base: base}
+	}
+	return &hc
 }
 
 func (c *client) Subscriptions(baseURL url.URL) subscription.SubscriptionAPI {
-	return subscription.New(baseURL)
+	return subscription.NewWithCache(baseURL, c.http, c.cache)
 }
 
 func (c *client) Discovery(baseURL url.URL) discovery.DiscoveryAPI {
-	return discovery.New(baseURL)
+	return discovery.NewWithCache(baseURL, c.http, c.cache)
+}
+
+// bearerTransport sets the Authorization header of every request.
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request.
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
 }
@@ -1,94 +1,372 @@
 package discovery
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client/cache"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client/paging"
 )
 
 type DiscoveryAPI interface {
 	Services() Services
+	Types() Types
 }
 
 type Services interface {
+	Create(ctx context.Context, s discovery.Service, opts *CreateOptions) (*discovery.Service, error)
+	Update(ctx context.Context, s discovery.Service, opts *UpdateOptions) (*discovery.Service, error)
+	Delete(ctx context.Context, id string, opts *DeleteOptions) error
 	Get(ctx context.Context, id string, opts *GetOptions) (*discovery.Service, error)
 	List(ctx context.Context, opts *ListOptions) ([]discovery.Service, error)
+	// Page returns a single page of services, and the token to pass as
+	// opts.Continue for the next page, "" on the last page.
+	Page(ctx context.Context, opts *ListOptions) ([]discovery.Service, string, error)
+}
+
+type Types interface {
+	Get(ctx context.Context, t string, opts *GetTypeOptions) (*discovery.Type, error)
+	List(ctx context.Context, opts *ListTypesOptions) ([]discovery.Type, error)
+}
+
+type CreateOptions struct{}
+
+type UpdateOptions struct {
+	// IfMatch makes the update conditional on the registered service having
+	// the entity tag. Defaults to the tag of the service when it was last
+	// retrieved or written by this client.
+	IfMatch string
+}
+
+type DeleteOptions struct {
+	// IfMatch makes the delete conditional on the registered service having
+	// the entity tag. Defaults to the tag of the service when it was last
+	// retrieved or written by this client.
+	IfMatch string
 }
 
 type GetOptions struct {
 }
 
 type ListOptions struct {
+	// Name filters to services with the name, case-insensitive.
 	Name string
+	// Protocol filters to services supporting the protocol.
+	Protocol string
+	// SpecVersion filters to services supporting the CloudEvents spec version.
+	SpecVersion string
+	// Type filters to services producing events of the type.
+	Type string
+	// Sort is the field to sort by, "id" (the default), "name" or "epoch",
+	// prefixed with "-" to sort descending.
+	Sort string
+	// Limit is the number of services per page, all services if zero. List
+	// fetches every page.
+	Limit int
+	// Continue is the token of the page for Page to fetch.
+	Continue string
 }
 
+func (o *ListOptions) query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	for k, v := range map[string]string{
+		"name":        o.Name,
+		"protocol":    o.Protocol,
+		"specversion": o.SpecVersion,
+		"type":        o.Type,
+		"sort":        o.Sort,
+		"continue":    o.Continue,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return q
+}
+
+type GetTypeOptions struct {
+}
+
+type ListTypesOptions struct {
+	// Matching filters to types containing the given string, case-insensitive.
+	Matching string
+	// Prefix filters to types starting with the given string.
+	Prefix string
+}
+
+// client.Discovery("url").Services().Create(svc)
+// client.Discovery("url").Services().Update(svc)
+// client.Discovery("url").Services().Delete(id)
 // client.Discovery("url").Services().Get(id)
 // client.Discovery("url").Services().List(opts)
+// client.Discovery("url").Types().Get(type)
+// client.Discovery("url").Types().List(opts)
 
 func New(baseURL url.URL) DiscoveryAPI {
-	return &client{baseURL: baseURL}
+	return NewWithHTTPClient(baseURL, http.DefaultClient)
+}
+
+// NewWithHTTPClient returns a client that makes requests with hc.
+func NewWithHTTPClient(baseURL url.URL, hc *http.Client) DiscoveryAPI {
+	return NewWithCache(baseURL, hc, nil)
+}
+
+// NewWithCache returns a client that makes requests with hc and caches
+// responses in c, making requests conditional on the cached entity tags.
+func NewWithCache(baseURL url.URL, hc *http.Client, c *cache.Cache) DiscoveryAPI {
+	return &client{baseURL: baseURL, http: hc, cache: c}
 }
 
 type client struct {
 	baseURL url.URL
+	http    *http.Client
+	cache   *cache.Cache
 }
 
 func (c *client) Services() Services {
 	return &services{c: c}
 }
 
+func (c *client) Types() Types {
+	return &types{c: c}
+}
+
 type services struct {
 	c *client
 }
 
+func (s *services) Create(ctx context.Context, svc discovery.Service, _ *CreateOptions) (*discovery.Service, error) {
+	return s.write(ctx, http.MethodPost, svc, "")
+}
+
+func (s *services) Update(ctx context.Context, svc discovery.Service, opts *UpdateOptions) (*discovery.Service, error) {
+	ifMatch := ""
+	if opts != nil {
+		ifMatch = opts.IfMatch
+	}
+	return s.write(ctx, http.MethodPut, svc, ifMatch)
+}
+
+// serviceURL is the url of the service, its cache key.
+func (s *services) serviceURL(id string) string {
+	return fmt.Sprintf("%s/services/%s", s.c.baseURL.String(), url.PathEscape(id))
+}
+
+func (s *services) write(ctx context.Context, method string, svc discovery.Service, ifMatch string) (*discovery.Service, error) {
+	target := fmt.Sprintf("%s/services", s.c.baseURL.String())
+
+	b := new(bytes.Buffer)
+	if err := json.NewEncoder(b).Encode(svc); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, b)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	} else if method == http.MethodPut {
+		s.c.cache.Precondition(req, s.serviceURL(svc.ID))
+	}
+	resp, err := s.c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%d, %s", resp.StatusCode, string(b))
+	}
+
+	written := new(discovery.Service)
+	if err := json.NewDecoder(resp.Body).Decode(written); err != nil {
+		return nil, err
+	}
+	s.c.cache.Put(s.serviceURL(written.ID), cache.Entry{ETag: resp.Header.Get("ETag"), Value: *written, Header: resp.Header})
+	return written, nil
+}
+
+func (s *services) Delete(ctx context.Context, id string, opts *DeleteOptions) error {
+	target := s.serviceURL(id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+	if opts != nil && opts.IfMatch != "" {
+		req.Header.Set("If-Match", opts.IfMatch)
+	} else {
+		s.c.cache.Precondition(req, target)
+	}
+	resp, err := s.c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%d, %s", resp.StatusCode, string(b))
+	}
+	s.c.cache.Delete(target)
+	return nil
+}
+
 func (s *services) Get(ctx context.Context, id string, _ *GetOptions) (*discovery.Service, error) {
-	target := fmt.Sprintf("%s/services/%s", s.c.baseURL.String(), id)
+	target := s.serviceURL(id)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	s.c.cache.Revalidate(req)
+	resp, err := s.c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		if e, ok := s.c.cache.Get(target); ok {
+			svc := e.Value.(discovery.Service)
+			return &svc, nil
+		}
+	}
 	if resp.StatusCode != 200 {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%d, %s", resp.Body, string(b))
+		return nil, fmt.Errorf("%d, %s", resp.StatusCode, string(b))
 	}
 
 	svc := new(discovery.Service)
 	if err := json.NewDecoder(resp.Body).Decode(svc); err != nil {
 		return nil, err
 	}
+	s.c.cache.Put(target, cache.Entry{ETag: resp.Header.Get("ETag"), Value: *svc, Header: resp.Header})
 	return svc, nil
 }
 
+// List returns every matching service, fetching page after page.
 func (s *services) List(ctx context.Context, opts *ListOptions) ([]discovery.Service, error) {
+	o := ListOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	svcs := make([]discovery.Service, 0)
+	for {
+		page, next, err := s.Page(ctx, &o)
+		if err != nil {
+			return nil, err
+		}
+		svcs = append(svcs, page...)
+		if next == "" {
+			return svcs, nil
+		}
+		o.Continue = next
+	}
+}
+
+func (s *services) Page(ctx context.Context, opts *ListOptions) ([]discovery.Service, string, error) {
 	target := fmt.Sprintf("%s/services", s.c.baseURL.String())
-	if opts != nil && opts.Name != "" {
-		target = fmt.Sprintf("%s?name=%s", target, opts.Name)
+	if q := opts.query(); len(q) > 0 {
+		target = fmt.Sprintf("%s?%s", target, q.Encode())
 	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	s.c.cache.Revalidate(req)
+	resp, err := s.c.http.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		if e, ok := s.c.cache.Get(target); ok {
+			cached := e.Value.([]discovery.Service)
+			return append([]discovery.Service(nil), cached...), paging.NextContinue(e.Header), nil
+		}
 	}
 	if resp.StatusCode != 200 {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%d, %s", resp.Body, string(b))
+		return nil, "", fmt.Errorf("%d, %s", resp.StatusCode, string(b))
 	}
 
 	svcs := make([]discovery.Service, 0)
 	if err := json.NewDecoder(resp.Body).Decode(&svcs); err != nil {
+		return nil, "", err
+	}
+	s.c.cache.Put(target, cache.Entry{ETag: resp.Header.Get("ETag"), Value: svcs, Header: resp.Header})
+	return append([]discovery.Service(nil), svcs...), paging.NextContinue(resp.Header), nil
+}
+
+type types struct {
+	c *client
+}
+
+func (t *types) Get(ctx context.Context, typ string, _ *GetTypeOptions) (*discovery.Type, error) {
+	target := fmt.Sprintf("%s/types/%s", t.c.baseURL.String(), url.PathEscape(typ))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%d, %s", resp.StatusCode, string(b))
+	}
+
+	found := new(discovery.Type)
+	if err := json.NewDecoder(resp.Body).Decode(found); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (t *types) List(ctx context.Context, opts *ListTypesOptions) ([]discovery.Type, error) {
+	target := fmt.Sprintf("%s/types", t.c.baseURL.String())
+	if opts != nil {
+		q := url.Values{}
+		if opts.Matching != "" {
+			q.Set("matching", opts.Matching)
+		}
+		if opts.Prefix != "" {
+			q.Set("prefix", opts.Prefix)
+		}
+		if len(q) > 0 {
+			target = fmt.Sprintf("%s?%s", target, q.Encode())
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%d, %s", resp.StatusCode, string(b))
+	}
+
+	found := make([]discovery.Type, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
 		return nil, err
 	}
-	return svcs, nil
+	return found, nil
 }
@@ -0,0 +1,107 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// closeTracker is a transport that counts the response bodies left open.
+type closeTracker struct {
+	mu   sync.Mutex
+	open int
+}
+
+func (c *closeTracker) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.open++
+	c.mu.Unlock()
+	resp.Body = &trackedBody{ReadCloser: resp.Body, c: c}
+	return resp, nil
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	c    *closeTracker
+	once sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		b.c.mu.Lock()
+		b.c.open--
+		b.c.mu.Unlock()
+	})
+	return b.ReadCloser.Close()
+}
+
+func TestTypesCloseResponseBodies(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		switch r.URL.Path {
+		case "/types":
+			_, _ = w.Write([]byte(`[{"type":"widget.created"}]`))
+		case "/types/widget.created":
+			_, _ = w.Write([]byte(`{"type":"widget.created"}`))
+		case "/types/invalid":
+			_, _ = w.Write([]byte(`{`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &closeTracker{}
+	types := NewWithHTTPClient(*u, &http.Client{Transport: tracker}).Types()
+	ctx := context.Background()
+
+	for name, tc := range map[string]struct {
+		call    func() error
+		wantErr bool
+	}{
+		"get": {call: func() error {
+			_, err := types.Get(ctx, "widget.created", nil)
+			return err
+		}},
+		"get missing": {call: func() error {
+			_, err := types.Get(ctx, "widget.deleted", nil)
+			return err
+		}, wantErr: true},
+		"get invalid": {call: func() error {
+			_, err := types.Get(ctx, "invalid", nil)
+			return err
+		}, wantErr: true},
+		"list": {call: func() error {
+			_, err := types.List(ctx, &ListTypesOptions{Matching: "created", Prefix: "widget."})
+			if query.Get("matching") != "created" || query.Get("prefix") != "widget." {
+				t.Errorf("got list query %v", query)
+			}
+			return err
+		}},
+		"list missing": {call: func() error {
+			_, err := NewWithHTTPClient(url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/missing"}, &http.Client{Transport: tracker}).Types().List(ctx, nil)
+			return err
+		}, wantErr: true},
+	} {
+		if err := tc.call(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %t", name, err, tc.wantErr)
+		}
+		tracker.mu.Lock()
+		if tracker.open != 0 {
+			t.Errorf("%s: left %d response bodies open", name, tracker.open)
+		}
+		tracker.mu.Unlock()
+	}
+}
@@ -0,0 +1,26 @@
+// Package paging reads the Link header of paged list responses.
+package paging
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NextContinue returns the continue token of the Link header's next page, ""
+// if there is no next page.
+func NextContinue(h http.Header) string {
+	for _, link := range strings.Split(h.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		for _, p := range parts[1:] {
+			if strings.TrimSpace(p) != `rel="next"` {
+				continue
+			}
+			if u, err := url.Parse(target); err == nil {
+				return u.Query().Get("continue")
+			}
+		}
+	}
+	return ""
+}
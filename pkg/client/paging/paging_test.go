@@ -0,0 +1,25 @@
+package paging
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNextContinue(t *testing.T) {
+	tests := map[string]string{
+		"": "",
+		`</services?limit=2&continue=abc>; rel="next"`:                                  "abc",
+		`</services?limit=2>; rel="prev", </services?limit=2&continue=def>; rel="next"`: "def",
+		`</services?limit=2&continue=abc>; rel="prev"`:                                  "",
+		`<http://cloudmeta.test/subscriptions?continue=a%2Fb>;rel="next"`:               "a/b",
+	}
+	for link, want := range tests {
+		h := http.Header{}
+		if link != "" {
+			h.Set("Link", link)
+		}
+		if got := NextContinue(h); got != want {
+			t.Errorf("%q: got %q, want %q", link, got, want)
+		}
+	}
+}
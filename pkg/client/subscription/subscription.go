@@ -8,8 +8,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client/cache"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client/paging"
 )
 
 type SubscriptionAPI interface {
@@ -22,26 +25,87 @@ type Subscription interface {
 	Delete(ctx context.Context, id string, opts *DeleteOptions) error
 	Get(ctx context.Context, id string, opts *GetOptions) (*subscription.Subscription, error)
 	List(ctx context.Context, opts *ListOptions) ([]subscription.Subscription, error)
+	// Page returns a single page of subscriptions, and the token to pass as
+	// opts.Continue for the next page, "" on the last page.
+	Page(ctx context.Context, opts *ListOptions) ([]subscription.Subscription, string, error)
 }
 
 type CreateOptions struct{}
-type UpdateOptions struct{}
-type DeleteOptions struct{}
+
+type UpdateOptions struct {
+	// IfMatch makes the update conditional on the subscription having the
+	// entity tag. Defaults to the tag of the subscription when it was last
+	// retrieved or written by this client.
+	IfMatch string
+}
+
+type DeleteOptions struct {
+	// IfMatch makes the delete conditional on the subscription having the
+	// entity tag. Defaults to the tag of the subscription when it was last
+	// retrieved or written by this client.
+	IfMatch string
+}
 type GetOptions struct{}
 
 type ListOptions struct {
 	Name string
+	// Protocol filters to subscriptions using the protocol.
+	Protocol string
+	// Sink filters to subscriptions delivering to the sink.
+	Sink string
+	// Sort is the field to sort by, "id" (the default), "protocol" or
+	// "sink", prefixed with "-" to sort descending.
+	Sort string
+	// Limit is the number of subscriptions per page, all subscriptions if
+	// zero. List fetches every page.
+	Limit int
+	// Continue is the token of the page for Page to fetch.
+	Continue string
+}
+
+func (o *ListOptions) query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	for k, v := range map[string]string{
+		"protocol": o.Protocol,
+		"sink":     o.Sink,
+		"sort":     o.Sort,
+		"continue": o.Continue,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return q
 }
 
 // client.Subscription("url").Subscriptions().Get(id)
 // client.Subscription("url").Subscriptions().List(opts)
 
 func New(baseURL url.URL) SubscriptionAPI {
-	return &client{baseURL: baseURL}
+	return NewWithHTTPClient(baseURL, http.DefaultClient)
+}
+
+// NewWithHTTPClient returns a client that makes requests with hc.
+func NewWithHTTPClient(baseURL url.URL, hc *http.Client) SubscriptionAPI {
+	return NewWithCache(baseURL, hc, nil)
+}
+
+// NewWithCache returns a client that makes requests with hc and caches
+// responses in c, making requests conditional on the cached entity tags.
+func NewWithCache(baseURL url.URL, hc *http.Client, c *cache.Cache) SubscriptionAPI {
+	return &client{baseURL: baseURL, http: hc, cache: c}
 }
 
 type client struct {
 	baseURL url.URL
+	http    *http.Client
+	cache   *cache.Cache
 }
 
 func (c *client) Subscriptions() Subscription {
@@ -52,6 +116,14 @@ type subscriptions struct {
 	c *client
 }
 
+// subscriptionURL is the url of the subscription, its cache key.
+func (s *subscriptions) subscriptionURL(id string) string {
+	return fmt.Sprintf("%s/subscriptions/%s", s.c.baseURL.String(), url.PathEscape(id))
+}
+
+// Create proposes the subscription, leaving the id empty lets the server
+// assign one. Returns the realized subscription with the assigned id and
+// defaults applied.
 func (s *subscriptions) Create(ctx context.Context, up subscription.Subscription, _ *CreateOptions) (*subscription.Subscription, error) {
 	target := fmt.Sprintf("%s/subscriptions", s.c.baseURL.String())
 
@@ -64,23 +136,26 @@ func (s *subscriptions) Create(ctx context.Context, up subscription.Subscription
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
+	defer resp.Body.Close()
+	// 201 when the subscription was created, 200 from older servers.
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%d, %s", resp.Body, string(b))
+		return nil, fmt.Errorf("%d, %s", resp.StatusCode, string(b))
 	}
 
 	sub := new(subscription.Subscription)
 	if err := json.NewDecoder(resp.Body).Decode(sub); err != nil {
 		return nil, err
 	}
+	s.c.cache.Put(s.subscriptionURL(sub.ID), cache.Entry{ETag: resp.Header.Get("ETag"), Value: *sub, Header: resp.Header})
 	return sub, nil
 }
 
-func (s *subscriptions) Update(ctx context.Context, up subscription.Subscription, _ *UpdateOptions) (*subscription.Subscription, error) {
+func (s *subscriptions) Update(ctx context.Context, up subscription.Subscription, opts *UpdateOptions) (*subscription.Subscription, error) {
 	target := fmt.Sprintf("%s/subscriptions", s.c.baseURL.String())
 
 	b := new(bytes.Buffer)
@@ -92,80 +167,135 @@ func (s *subscriptions) Update(ctx context.Context, up subscription.Subscription
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if opts != nil && opts.IfMatch != "" {
+		req.Header.Set("If-Match", opts.IfMatch)
+	} else {
+		s.c.cache.Precondition(req, s.subscriptionURL(up.ID))
+	}
+	resp, err := s.c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
+	defer resp.Body.Close()
+	// 201 when the update created the subscription.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%d, %s", resp.Body, string(b))
+		return nil, fmt.Errorf("%d, %s", resp.StatusCode, string(b))
 	}
 
 	sub := new(subscription.Subscription)
 	if err := json.NewDecoder(resp.Body).Decode(sub); err != nil {
 		return nil, err
 	}
+	s.c.cache.Put(s.subscriptionURL(sub.ID), cache.Entry{ETag: resp.Header.Get("ETag"), Value: *sub, Header: resp.Header})
 	return sub, nil
 }
 
-func (s *subscriptions) Delete(ctx context.Context, id string, _ *DeleteOptions) error {
-	target := fmt.Sprintf("%s/subscriptions/%s", s.c.baseURL.String(), id)
+func (s *subscriptions) Delete(ctx context.Context, id string, opts *DeleteOptions) error {
+	target := s.subscriptionURL(id)
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
 	if err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if opts != nil && opts.IfMatch != "" {
+		req.Header.Set("If-Match", opts.IfMatch)
+	} else {
+		s.c.cache.Precondition(req, target)
+	}
+	resp, err := s.c.http.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("%d, %s", resp.Body, string(b))
+		return fmt.Errorf("%d, %s", resp.StatusCode, string(b))
 	}
+	s.c.cache.Delete(target)
 	return nil
 }
 
 func (s *subscriptions) Get(ctx context.Context, id string, _ *GetOptions) (*subscription.Subscription, error) {
-	target := fmt.Sprintf("%s/subscriptions/%s", s.c.baseURL.String(), id)
+	target := s.subscriptionURL(id)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	s.c.cache.Revalidate(req)
+	resp, err := s.c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		if e, ok := s.c.cache.Get(target); ok {
+			sub := e.Value.(subscription.Subscription)
+			return &sub, nil
+		}
+	}
 	if resp.StatusCode != 200 {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%d, %s", resp.Body, string(b))
+		return nil, fmt.Errorf("%d, %s", resp.StatusCode, string(b))
 	}
 
 	sub := new(subscription.Subscription)
 	if err := json.NewDecoder(resp.Body).Decode(sub); err != nil {
 		return nil, err
 	}
+	s.c.cache.Put(target, cache.Entry{ETag: resp.Header.Get("ETag"), Value: *sub, Header: resp.Header})
 	return sub, nil
 }
 
-func (s *subscriptions) List(ctx context.Context, _ *ListOptions) ([]subscription.Subscription, error) {
-	target := fmt.Sprintf("%s/subscriptions", s.c.baseURL.String())
+// List returns every matching subscription, fetching page after page.
+func (s *subscriptions) List(ctx context.Context, opts *ListOptions) ([]subscription.Subscription, error) {
+	o := ListOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	subs := make([]subscription.Subscription, 0)
+	for {
+		page, next, err := s.Page(ctx, &o)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, page...)
+		if next == "" {
+			return subs, nil
+		}
+		o.Continue = next
+	}
+}
 
+func (s *subscriptions) Page(ctx context.Context, opts *ListOptions) ([]subscription.Subscription, string, error) {
+	target := fmt.Sprintf("%s/subscriptions", s.c.baseURL.String())
+	if q := opts.query(); len(q) > 0 {
+		target = fmt.Sprintf("%s?%s", target, q.Encode())
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	s.c.cache.Revalidate(req)
+	resp, err := s.c.http.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		if e, ok := s.c.cache.Get(target); ok {
+			cached := e.Value.([]subscription.Subscription)
+			return append([]subscription.Subscription(nil), cached...), paging.NextContinue(e.Header), nil
+		}
 	}
 	if resp.StatusCode != 200 {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%d, %s", resp.Body, string(b))
+		return nil, "", fmt.Errorf("%d, %s", resp.StatusCode, string(b))
 	}
 
 	subs := make([]subscription.Subscription, 0)
 	if err := json.NewDecoder(resp.Body).Decode(&subs); err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return subs, nil
+	s.c.cache.Put(target, cache.Entry{ETag: resp.Header.Get("ETag"), Value: subs, Header: resp.Header})
+	return append([]subscription.Subscription(nil), subs...), paging.NextContinue(resp.Header), nil
 }
@@ -0,0 +1,53 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cloudevents/sdk-go/v2/types"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+)
+
+func TestCreateReturnsRealized(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proposed := new(subscription.Subscription)
+		if err := json.NewDecoder(r.Body).Decode(proposed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodPost || proposed.ID != "" {
+			http.Error(w, "want a POST without an id", http.StatusBadRequest)
+			return
+		}
+		// The server assigns the id and realizes the settings.
+		proposed.ID = "assigned"
+		if err := proposed.SetDefaults(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/subscriptions/assigned")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(proposed)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := New(*u).Subscriptions().Create(context.Background(), subscription.Subscription{Protocol: "MQTT3", Sink: *types.ParseURI("mqtt://broker.test/events")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "assigned" {
+		t.Errorf("got id %q, want the assigned id", got.ID)
+	}
+	if got.ProtocolSettings == nil || string(*got.ProtocolSettings) != `{"topicname":"","qos":1,"retain":false}` {
+		t.Errorf("got protocol settings %v, want the realized settings", got.ProtocolSettings)
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// etag returns a strong entity tag for the representation, a hash of its
+// content.
+func etag(representation []byte) string {
+	sum := sha256.Sum256(representation)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagListed returns true if the If-Match or If-None-Match header lists the
+// tag or is "*". Weak tags never match a strong comparison, for If-Match.
+func etagListed(header, tag string, weak bool) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified responds 304 if the request's If-None-Match lists the tag of
+// the current representation.
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || !etagListed(inm, tag, true) {
+		return false
+	}
+	w.Header().Set("ETag", tag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// preconditionFailed responds 412 if the request has an If-Match that does
+// not list the tag of the current representation, or the resource does not
+// exist. tag is "" if it does not.
+func preconditionFailed(w http.ResponseWriter, r *http.Request, tag string) bool {
+	im := r.Header.Get("If-Match")
+	if im == "" || (tag != "" && etagListed(im, tag, false)) {
+		return false
+	}
+	if tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+	http.Error(w, "precondition failed, the resource has changed", http.StatusPreconditionFailed)
+	return true
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/background"
+	"github.com/n3wscott/cloudevents-discovery/pkg/logging"
+)
+
+// conditional is a resource served with entity tags.
+type conditional struct {
+	collection string
+	// body returns the representation of version v of the resource "x".
+	body func(v int) string
+	h    http.Handler
+}
+
+func conditionals() map[string]func() conditional {
+	return map[string]func() conditional{
+		"services": func() conditional {
+			return conditional{
+				collection: "/services",
+				body:       func(v int) string { return fmt.Sprintf(`{"id":"x","name":"widgets","epoch":%d}`, v) },
+				h:          NewServiceHandler(background.NewServiceStore()),
+			}
+		},
+		"subscriptions": func() conditional {
+			return conditional{
+				collection: "/subscriptions",
+				body:       func(v int) string { return fmt.Sprintf(`{"id":"x","protocol":"HTTP","sink":"http://sink%d.test"}`, v) },
+				h:          NewSubscriptionHandler(background.NewSubscriptionStore(), nil),
+			}
+		},
+	}
+}
+
+// do makes the request with the headers, name value pairs.
+func (c conditional) do(t *testing.T, method, target, body string, want int, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := mux.NewRouter()
+	r.Handle(c.collection, c.h)
+	r.Handle(c.collection+"/{id}", c.h)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req = req.WithContext(logging.WithLogger(req.Context(), zap.NewNop().Sugar()))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	r.ServeHTTP(w, req)
+	if w.Code != want {
+		t.Fatalf("%s %s %v: got %d, want %d: %s", method, target, headers, w.Code, want, w.Body.String())
+	}
+	return w
+}
+
+var strongETag = regexp.MustCompile(`^"[0-9a-f]{32}"$`)
+
+func TestETagIfNoneMatch(t *testing.T) {
+	for name, resource := range conditionals() {
+		t.Run(name, func(t *testing.T) {
+			c := resource()
+			c.do(t, http.MethodPost, c.collection, c.body(1), http.StatusCreated)
+			item := c.collection + "/x"
+
+			w := c.do(t, http.MethodGet, item, "", http.StatusOK)
+			tag := w.Header().Get("ETag")
+			if !strongETag.MatchString(tag) {
+				t.Fatalf("got ETag %q, want a strong tag", tag)
+			}
+			if want := etag(w.Body.Bytes()); tag != want {
+				t.Errorf("got ETag %s, want the hash of the body %s", tag, want)
+			}
+			// The tag is stable while the resource is.
+			if again := c.do(t, http.MethodGet, item, "", http.StatusOK).Header().Get("ETag"); again != tag {
+				t.Errorf("got ETag %s, then %s", tag, again)
+			}
+
+			for _, inm := range []string{tag, "W/" + tag, `"other", ` + tag, "*"} {
+				w := c.do(t, http.MethodGet, item, "", http.StatusNotModified, "If-None-Match", inm)
+				if w.Body.Len() != 0 || w.Header().Get("ETag") != tag {
+					t.Errorf("If-None-Match %s: got 304 with ETag %q and body %q", inm, w.Header().Get("ETag"), w.Body.String())
+				}
+			}
+			c.do(t, http.MethodGet, item, "", http.StatusOK, "If-None-Match", `"other"`)
+
+			// Changing the resource changes its tag.
+			c.do(t, http.MethodPut, c.collection, c.body(2), http.StatusOK)
+			w = c.do(t, http.MethodGet, item, "", http.StatusOK, "If-None-Match", tag)
+			if w.Header().Get("ETag") == tag {
+				t.Error("ETag did not change with the resource")
+			}
+
+			// Lists are tagged too.
+			list := c.do(t, http.MethodGet, c.collection, "", http.StatusOK)
+			c.do(t, http.MethodGet, c.collection, "", http.StatusNotModified, "If-None-Match", list.Header().Get("ETag"))
+		})
+	}
+}
+
+func TestETagIfMatch(t *testing.T) {
+	for name, resource := range conditionals() {
+		t.Run(name, func(t *testing.T) {
+			c := resource()
+			item := c.collection + "/x"
+
+			// If-Match never matches a missing resource, not even "*".
+			c.do(t, http.MethodPut, c.collection, c.body(1), http.StatusPreconditionFailed, "If-Match", "*")
+
+			tag := c.do(t, http.MethodPost, c.collection, c.body(1), http.StatusCreated).Header().Get("ETag")
+			if got := c.do(t, http.MethodGet, item, "", http.StatusOK).Header().Get("ETag"); got != tag {
+				t.Fatalf("write responded ETag %s, get %s", tag, got)
+			}
+
+			// A stale or weak tag fails, responding the current tag.
+			for _, im := range []string{`"stale"`, "W/" + tag} {
+				w := c.do(t, http.MethodPut, c.collection, c.body(2), http.StatusPreconditionFailed, "If-Match", im)
+				if got := w.Header().Get("ETag"); got != tag {
+					t.Errorf("If-Match %s: got ETag %q, want %s", im, got, tag)
+				}
+				c.do(t, http.MethodDelete, item, "", http.StatusPreconditionFailed, "If-Match", im)
+			}
+
+			next := c.do(t, http.MethodPut, c.collection, c.body(2), http.StatusOK, "If-Match", tag).Header().Get("ETag")
+			c.do(t, http.MethodPut, c.collection, c.body(3), http.StatusPreconditionFailed, "If-Match", tag)
+			c.do(t, http.MethodDelete, item, "", http.StatusPreconditionFailed, "If-Match", tag)
+			c.do(t, http.MethodDelete, item, "", http.StatusOK, "If-Match", `"other", `+next)
+			c.do(t, http.MethodGet, item, "", http.StatusNotFound)
+		})
+	}
+}
@@ -61,5 +61,5 @@ const exampleSubscriptions = `[{
 		"qos": 2,
 		"retain": true
 	},
-	"sink": "http://localhost:1337"
+	"sink": "mqtt://localhost:1883"
 }]`
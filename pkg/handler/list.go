@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// listOptions are the sorting and pagination query parameters of a list
+// request:
+//
+//	sort=<field>      sort by field, ascending, "-<field>" for descending.
+//	limit=<n>         return at most n items, all items if unset.
+//	continue=<token>  return the page after the token from the previous
+//	                  page's Link header.
+type listOptions struct {
+	sort  string
+	field string
+	desc  bool
+	limit int
+	after *sortKey
+}
+
+// sortKey orders an item by its sort field, then by id so every order is
+// total and a cursor can pick up after any item.
+type sortKey struct {
+	// Sort is the sort the key was made for.
+	Sort string `json:"s"`
+	// Str or Num holds the value of the sort field.
+	Str string `json:"v,omitempty"`
+	Num int    `json:"n,omitempty"`
+	ID  string `json:"id"`
+}
+
+func (k sortKey) less(o sortKey) bool {
+	if k.Num != o.Num {
+		return k.Num < o.Num
+	}
+	if k.Str != o.Str {
+		return k.Str < o.Str
+	}
+	return k.ID < o.ID
+}
+
+// parseListOptions reads the list options from the query, fields are the
+// fields that may be sorted by, the first is the default.
+func parseListOptions(q url.Values, fields ...string) (*listOptions, error) {
+	opts := &listOptions{sort: q.Get("sort")}
+	if opts.sort == "" {
+		opts.sort = fields[0]
+	}
+	opts.field = strings.TrimPrefix(opts.sort, "-")
+	opts.desc = opts.field != opts.sort
+	known := false
+	for _, f := range fields {
+		known = known || f == opts.field
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown sort field %q, must be one of %v", opts.field, fields)
+	}
+
+	if l := q.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("limit must be a positive integer")
+		}
+		opts.limit = limit
+	}
+
+	if c := q.Get("continue"); c != "" {
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid continue token")
+		}
+		after := new(sortKey)
+		if err := json.Unmarshal(b, after); err != nil {
+			return nil, fmt.Errorf("invalid continue token")
+		}
+		if after.Sort != opts.sort {
+			return nil, fmt.Errorf("continue token is for sort %q, not %q", after.Sort, opts.sort)
+		}
+		opts.after = after
+	}
+	return opts, nil
+}
+
+// page sorts the n items by their keys and returns the indices of the items
+// on the requested page, with the token for the next page or "" if this is
+// the last page.
+func (o *listOptions) page(n int, key func(i int) sortKey) ([]int, string) {
+	keys := make([]sortKey, n)
+	idx := make([]int, n)
+	for i := range keys {
+		keys[i] = key(i)
+		keys[i].Sort = o.sort
+		idx[i] = i
+	}
+	before := func(a, b sortKey) bool {
+		if o.desc {
+			return b.less(a)
+		}
+		return a.less(b)
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return before(keys[idx[i]], keys[idx[j]])
+	})
+
+	start := 0
+	if o.after != nil {
+		start = sort.Search(n, func(i int) bool {
+			return before(*o.after, keys[idx[i]])
+		})
+	}
+	idx = idx[start:]
+	if o.limit == 0 || len(idx) <= o.limit {
+		return idx, ""
+	}
+	idx = idx[:o.limit]
+	b, _ := json.Marshal(keys[idx[len(idx)-1]])
+	return idx, base64.RawURLEncoding.EncodeToString(b)
+}
+
+// setNextLink sets a Link header to the next page of the request if there
+// is one.
+func setNextLink(w http.ResponseWriter, r *http.Request, token string) {
+	if token == "" {
+		return
+	}
+	q := r.URL.Query()
+	q.Set("continue", token)
+	next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+}
+
+// containsFold returns true if list contains s, case-insensitive.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
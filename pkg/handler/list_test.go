@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/background"
+	"github.com/n3wscott/cloudevents-discovery/pkg/client/paging"
+	"github.com/n3wscott/cloudevents-discovery/pkg/logging"
+)
+
+// listRouter serves subscriptions with the ids, protocols and sinks.
+func listRouter(t *testing.T) *mux.Router {
+	t.Helper()
+	subs := make([]subscription.Subscription, 0)
+	for _, s := range []struct{ id, protocol, sink string }{
+		{"d", "HTTP", "http://b.test"},
+		{"a", "KAFKA", "kafka://c.test/topic"},
+		{"c", "HTTP", "http://a.test"},
+		{"e", "NATS", "nats://d.test/subject"},
+		{"b", "HTTP", "http://e.test"},
+	} {
+		subs = append(subs, subscription.Subscription{ID: s.id, Protocol: s.protocol, Sink: *types.ParseURI(s.sink)})
+	}
+	h := NewSubscriptionHandler(background.NewSubscriptionStore(subs...), nil)
+	r := mux.NewRouter()
+	r.Handle("/subscriptions", h)
+	return r
+}
+
+// list gets the target, returning the ids listed and the response.
+func list(t *testing.T, r *mux.Router, target string, want int) ([]string, *httptest.ResponseRecorder) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req = req.WithContext(logging.WithLogger(req.Context(), zap.NewNop().Sugar()))
+	r.ServeHTTP(w, req)
+	if w.Code != want {
+		t.Fatalf("GET %s: got %d, want %d: %s", target, w.Code, want, w.Body.String())
+	}
+	if w.Code != http.StatusOK {
+		return nil, w
+	}
+	var subs []subscription.Subscription
+	if err := json.Unmarshal(w.Body.Bytes(), &subs); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID)
+	}
+	return ids, w
+}
+
+// listAll follows the Link headers from the target, returning the ids of
+// each page.
+func listAll(t *testing.T, r *mux.Router, target string) [][]string {
+	t.Helper()
+	pages := make([][]string, 0)
+	for target != "" {
+		ids, w := list(t, r, target, http.StatusOK)
+		pages = append(pages, ids)
+		target = ""
+		if link := w.Header().Get("Link"); link != "" {
+			next := strings.TrimPrefix(strings.SplitN(link, ">", 2)[0], "<")
+			if !strings.HasPrefix(next, "/subscriptions?") {
+				t.Fatalf("Link %q does not point at the list", link)
+			}
+			target = next
+		}
+		if len(pages) > 10 {
+			t.Fatal("pagination does not end")
+		}
+	}
+	return pages
+}
+
+func TestListPagination(t *testing.T) {
+	tests := map[string]struct {
+		target string
+		want   [][]string
+	}{
+		"unpaginated": {
+			target: "/subscriptions",
+			want:   [][]string{{"a", "b", "c", "d", "e"}},
+		},
+		"pages": {
+			target: "/subscriptions?limit=2",
+			want:   [][]string{{"a", "b"}, {"c", "d"}, {"e"}},
+		},
+		"limit at the end": {
+			target: "/subscriptions?limit=5",
+			want:   [][]string{{"a", "b", "c", "d", "e"}},
+		},
+		"limit beyond the end": {
+			target: "/subscriptions?limit=50",
+			want:   [][]string{{"a", "b", "c", "d", "e"}},
+		},
+		"descending": {
+			target: "/subscriptions?sort=-id&limit=3",
+			want:   [][]string{{"e", "d", "c"}, {"b", "a"}},
+		},
+		"protocol": {
+			target: "/subscriptions?sort=protocol&limit=2",
+			want:   [][]string{{"b", "c"}, {"d", "a"}, {"e"}},
+		},
+		"descending protocol": {
+			target: "/subscriptions?sort=-protocol&limit=2",
+			want:   [][]string{{"e", "a"}, {"d", "c"}, {"b"}},
+		},
+		"sink": {
+			target: "/subscriptions?sort=sink&limit=4",
+			want:   [][]string{{"c", "d", "b", "a"}, {"e"}},
+		},
+		"descending sink": {
+			target: "/subscriptions?sort=-sink&limit=4",
+			want:   [][]string{{"e", "a", "b", "d"}, {"c"}},
+		},
+		"filtered": {
+			target: "/subscriptions?protocol=http&limit=2",
+			want:   [][]string{{"b", "c"}, {"d"}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := listAll(t, listRouter(t), tc.target); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got pages %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestListLinkHeader(t *testing.T) {
+	r := listRouter(t)
+	_, w := list(t, r, "/subscriptions?protocol=HTTP&sort=-sink&limit=1", http.StatusOK)
+	link := w.Header().Get("Link")
+	if !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Fatalf("got Link %q, want a next link", link)
+	}
+	next, err := url.Parse(strings.TrimPrefix(strings.SplitN(link, ">", 2)[0], "<"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The next link keeps the query, adding the continue token the client
+	// reads back.
+	q := next.Query()
+	if next.Path != "/subscriptions" || q.Get("protocol") != "HTTP" || q.Get("sort") != "-sink" || q.Get("limit") != "1" {
+		t.Errorf("got next link %q", next)
+	}
+	if got := paging.NextContinue(w.Header()); got == "" || got != q.Get("continue") {
+		t.Errorf("client read continue token %q from %q", got, link)
+	}
+
+	// The last page has no Link.
+	_, w = list(t, r, "/subscriptions?limit=5", http.StatusOK)
+	if link := w.Header().Get("Link"); link != "" {
+		t.Errorf("got Link %q on the last page", link)
+	}
+}
+
+func TestListBadOptions(t *testing.T) {
+	token := func(k sortKey) string {
+		b, _ := json.Marshal(k)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	for name, query := range map[string]string{
+		"unknown sort":       "sort=name",
+		"zero limit":         "limit=0",
+		"negative limit":     "limit=-1",
+		"word limit":         "limit=ten",
+		"not base64":         "continue=%21%21%21",
+		"not json":           "continue=" + base64.RawURLEncoding.EncodeToString([]byte("{id")),
+		"tampered sort":      "continue=" + token(sortKey{Sort: "protocol", ID: "a"}),
+		"token of desc sort": "sort=id&continue=" + token(sortKey{Sort: "-id", ID: "a"}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			list(t, listRouter(t), fmt.Sprintf("/subscriptions?%s", query), http.StatusBadRequest)
+		})
+	}
+}
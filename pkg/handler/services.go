@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/n3wscott/cloudevents-discovery/pkg/background"
 	"io/ioutil"
 	"net/http"
@@ -9,20 +11,24 @@ import (
 	"sync"
 
 	"github.com/gorilla/mux"
+	"go.uber.org/zap"
 
 	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/auth"
+	"github.com/n3wscott/cloudevents-discovery/pkg/logging"
 )
 
 type ServicesHandler struct {
-	once     sync.Once
-	services []discovery.Service
-
-	changes chan<- background.ServiceChange
+	once  sync.Once
+	store background.ServiceStore
+	// writes serializes changes, so a conditional change is made to the
+	// service its precondition was checked against.
+	writes sync.Mutex
 }
 
-func NewServiceHandler(changes chan<- background.ServiceChange) *ServicesHandler {
+func NewServiceHandler(store background.ServiceStore) *ServicesHandler {
 	return &ServicesHandler{
-		changes: changes,
+		store: store,
 	}
 }
 
@@ -36,127 +42,297 @@ func (h *ServicesHandler) LoadServicesFromFile(file string) error {
 			onceErr = err
 			return
 		}
-		h.services = make([]discovery.Service, 0)
-		if err := json.Unmarshal(services, &h.services); err != nil {
-			onceErr = err
-			return
-		}
+		onceErr = h.load(services)
 	})
 	return onceErr
 }
 
-func (h *ServicesHandler) Set(service discovery.Service) {
-	for i, svc := range h.services {
-		if svc.ID == service.ID {
-			if service.Epoch > svc.Epoch {
-				h.services[i] = service
-				// And vent.
-				if h.changes != nil {
-					h.changes <- background.ServiceChange{
-						Change:  "updated",
-						Service: service,
-					}
-				}
-			}
-			return
-		}
+func (h *ServicesHandler) load(b []byte) error {
+	services := make([]discovery.Service, 0)
+	if err := json.Unmarshal(b, &services); err != nil {
+		return err
 	}
-	h.services = append(h.services, service)
-	// And vent.
-	if h.changes != nil {
-		h.changes <- background.ServiceChange{
-			Change:  "added",
-			Service: service,
-		}
+	for _, svc := range services {
+		h.Set(context.Background(), svc)
+	}
+	return nil
+}
+
+// Set stores the service if it is new or has a newer epoch than the stored
+// service.
+func (h *ServicesHandler) Set(ctx context.Context, service discovery.Service) {
+	h.writes.Lock()
+	defer h.writes.Unlock()
+	// Stale epochs are expected from aggregation, ignore them.
+	_ = h.store.Upsert(ctx, service)
+}
+
+// Delete removes the service, unless the stored service has a newer epoch.
+func (h *ServicesHandler) Delete(ctx context.Context, service discovery.Service) {
+	h.writes.Lock()
+	defer h.writes.Unlock()
+	if stored, found := h.store.Get(service.ID); found && stored.Epoch <= service.Epoch {
+		h.store.Delete(ctx, service.ID)
 	}
 }
 
 // -- HTTP --
 
 func (h *ServicesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.once.Do(func() {
-		h.services = make([]discovery.Service, 0)
-		err := json.Unmarshal([]byte(exampleServices), &h.services)
-		if err != nil {
-			panic(err)
-		}
-	})
+	h.loadExamples()
 
 	vars := mux.Vars(r)
 	id := vars["id"]
-	if id == "" {
-		h.handleList(w, r)
-	} else {
-		h.handleGet(id, w, r)
+
+	switch r.Method {
+	case http.MethodOptions:
+		if id != "" {
+			w.Header().Set("Allow", "GET,DELETE,OPTIONS")
+		} else {
+			w.Header().Set("Allow", "GET,PUT,POST,OPTIONS")
+		}
+
+	case http.MethodGet:
+		if id == "" {
+			h.handleList(w, r)
+		} else {
+			h.handleGet(id, w, r)
+		}
+
+	case http.MethodPost, http.MethodPut:
+		if id != "" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		h.handleCreateOrUpdate(w, r)
+
+	case http.MethodDelete:
+		h.handleDelete(id, w, r)
+
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
 	}
 }
 
+// loadExamples fills in the example services if no services file was loaded.
+func (h *ServicesHandler) loadExamples() {
+	h.once.Do(func() {
+		if err := h.load([]byte(exampleServices)); err != nil {
+			panic(err)
+		}
+	})
+}
+
 func (h *ServicesHandler) GetServices() []discovery.Service {
-	return h.services
+	h.loadExamples()
+	return h.store.List()
 }
 
-func (h *ServicesHandler) CreateOrUpdateService(s discovery.Service) {
-	for i, old := range h.services {
-		if old.ID == s.ID {
-			h.services[i] = s
+// visibleServices returns the services the context's principal can see.
+func (h *ServicesHandler) visibleServices(ctx context.Context) []discovery.Service {
+	h.loadExamples()
+	principal := auth.FromContext(ctx)
+	services := make([]discovery.Service, 0)
+	for _, svc := range h.store.List() {
+		if principal.CanSee(svc.AuthScope) {
+			services = append(services, svc)
 		}
 	}
-	h.services = append(h.services, s)
+	return services
+}
+
+func (h *ServicesHandler) CreateOrUpdateService(ctx context.Context, s discovery.Service) error {
+	return h.store.Upsert(ctx, s)
+}
+
+func (h *ServicesHandler) DeleteService(ctx context.Context, id string) bool {
+	_, found := h.store.Delete(ctx, id)
+	return found
 }
 
-func (h *ServicesHandler) DeleteService(id string) {
-	for i, old := range h.services {
-		if old.ID == id {
-			// And vent.
-			if h.changes != nil {
-				h.changes <- background.ServiceChange{
-					Change:  "deleted",
-					Service: old,
-				}
-			}
+// handleCreateOrUpdate registers a service. POST creates a new service and
+// conflicts if the id is already registered, PUT creates or updates. Updates
+// must carry an epoch greater than the registered service's epoch, and
+// If-Match makes them conditional on the registered service not having
+// changed.
+func (h *ServicesHandler) handleCreateOrUpdate(w http.ResponseWriter, r *http.Request) {
+	svc := new(discovery.Service)
+
+	err := json.NewDecoder(r.Body).Decode(svc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			h.services = append(h.services[:i], h.services[i+1:]...)
+	if svc.ID == "" {
+		http.Error(w, "service id is required", http.StatusBadRequest)
+		return
+	}
+
+	h.writes.Lock()
+	defer h.writes.Unlock()
+
+	// Principals may only register services they are able to see.
+	principal := auth.FromContext(r.Context())
+	if !principal.CanSee(svc.AuthScope) {
+		http.Error(w, fmt.Sprintf("not permitted to register services with authscope %q", svc.AuthScope), http.StatusForbidden)
+		return
+	}
+	existing, found := h.store.Get(svc.ID)
+	if found && !principal.CanSee(existing.AuthScope) {
+		http.Error(w, fmt.Sprintf("not permitted to replace service %q", svc.ID), http.StatusForbidden)
+		return
+	}
+	if found && r.Method == http.MethodPost {
+		http.Error(w, fmt.Sprintf("service %q already exists", svc.ID), http.StatusConflict)
+		return
+	}
+	current := ""
+	if found {
+		if current, err = serviceETag(existing); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
+	if preconditionFailed(w, r, current) {
+		return
+	}
+
+	// Save, the store will vent.
+	logger := logging.FromContext(r.Context())
+	if err := h.CreateOrUpdateService(r.Context(), *svc); err == background.ErrStaleEpoch {
+		http.Error(w, fmt.Sprintf("service %q: %v", svc.ID, err), http.StatusConflict)
+		return
+	} else if err != nil {
+		logger.Errorw("failed to save service", "service", svc.ID, zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("service saved", "service", svc.ID, "epoch", svc.Epoch)
+
+	js, err := json.Marshal(svc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(js))
+	if found {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.Header().Set("Location", fmt.Sprintf("/services/%s", svc.ID))
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(js)
 }
 
+// handleDelete removes a service, If-Match makes the delete conditional on
+// the service not having changed.
+func (h *ServicesHandler) handleDelete(id string, w http.ResponseWriter, r *http.Request) {
+	h.writes.Lock()
+	defer h.writes.Unlock()
+
+	// Services the principal cannot see are not found.
+	svc, found := h.store.Get(id)
+	if !found || !auth.FromContext(r.Context()).CanSee(svc.AuthScope) {
+		http.Error(w, fmt.Sprintf("service %q not found", id), http.StatusNotFound)
+		return
+	}
+	current, err := serviceETag(svc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if preconditionFailed(w, r, current) {
+		return
+	}
+	if !h.DeleteService(r.Context(), id) {
+		http.Error(w, fmt.Sprintf("service %q not found", id), http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Infow("service deleted", "service", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleList lists the visible services, filtered by the name, protocol,
+// specversion and type query parameters. Results are sorted by id, name or
+// epoch and paginated, see listOptions.
 func (h *ServicesHandler) handleList(w http.ResponseWriter, r *http.Request) {
-	services := h.services
-
-	// Check to see if there is a filter.
-	name := r.URL.Query().Get("name")
-	if name != "" {
-		name = strings.ToLower(name)
-		services = make([]discovery.Service, 0)
-		// Filter.
-		for _, v := range h.services {
-			if strings.ToLower(v.Name) == name {
-				services = append(services, v)
-			}
+	q := r.URL.Query()
+	opts, err := parseListOptions(q, "id", "name", "epoch")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check to see if there are filters.
+	name := strings.ToLower(q.Get("name"))
+	protocol := q.Get("protocol")
+	specVersion := q.Get("specversion")
+	eventType := q.Get("type")
+
+	services := make([]discovery.Service, 0)
+	for _, v := range h.visibleServices(r.Context()) {
+		if name != "" && strings.ToLower(v.Name) != name {
+			continue
+		}
+		if protocol != "" && !containsFold(v.Protocols, protocol) {
+			continue
+		}
+		if specVersion != "" && !containsFold(v.SpecVersions, specVersion) {
+			continue
+		}
+		if eventType != "" && !producesType(v, eventType) {
+			continue
+		}
+		services = append(services, v)
+	}
+
+	idx, next := opts.page(len(services), func(i int) sortKey {
+		switch opts.field {
+		case "name":
+			return sortKey{Str: services[i].Name, ID: services[i].ID}
+		case "epoch":
+			return sortKey{Num: services[i].Epoch, ID: services[i].ID}
 		}
+		return sortKey{ID: services[i].ID}
+	})
+	page := make([]discovery.Service, 0, len(idx))
+	for _, i := range idx {
+		page = append(page, services[i])
 	}
 
-	js, err := json.Marshal(services)
+	js, err := json.Marshal(page)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	tag := etag(js)
+	if notModified(w, r, tag) {
+		return
+	}
+	setNextLink(w, r, next)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", tag)
 	w.WriteHeader(http.StatusOK)
 	w.Write(js)
 }
 
-func (h *ServicesHandler) handleGet(id string, w http.ResponseWriter, r *http.Request) {
-	var service *discovery.Service
-
-	for _, v := range h.services {
-		if v.ID == id {
-			service = &v
+// producesType returns true if the service produces events of the type.
+func producesType(svc discovery.Service, t string) bool {
+	for _, e := range svc.Events {
+		if e.Type == t {
+			return true
 		}
 	}
+	return false
+}
 
-	if service == nil {
+func (h *ServicesHandler) handleGet(id string, w http.ResponseWriter, r *http.Request) {
+	service, found := h.store.Get(id)
+	if !found || !auth.FromContext(r.Context()).CanSee(service.AuthScope) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -167,7 +343,21 @@ func (h *ServicesHandler) handleGet(id string, w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	tag := etag(js)
+	if notModified(w, r, tag) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", tag)
 	w.WriteHeader(http.StatusOK)
 	w.Write(js)
 }
+
+// serviceETag returns the entity tag of the service's representation.
+func serviceETag(svc discovery.Service) (string, error) {
+	js, err := json.Marshal(svc)
+	if err != nil {
+		return "", err
+	}
+	return etag(js), nil
+}
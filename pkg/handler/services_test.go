@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/background"
+	"github.com/n3wscott/cloudevents-discovery/pkg/logging"
+)
+
+func TestServicesCreateAndUpdate(t *testing.T) {
+	h := NewServiceHandler(background.NewServiceStore())
+	r := mux.NewRouter()
+	r.Handle("/services", h)
+	r.Handle("/services/{id}", h)
+
+	do := func(method, body string, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/services", strings.NewReader(body))
+		req = req.WithContext(logging.WithLogger(req.Context(), zap.NewNop().Sugar()))
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("%s: got %d, want %d: %s", method, w.Code, want, w.Body.String())
+		}
+		return w
+	}
+
+	w := do(http.MethodPost, `{"id":"abc","name":"widgets","epoch":1}`, http.StatusCreated)
+	if got := w.Header().Get("Location"); got != "/services/abc" {
+		t.Errorf("got Location %q, want /services/abc", got)
+	}
+	do(http.MethodPost, `{"id":"abc","name":"widgets","epoch":2}`, http.StatusConflict)
+	w = do(http.MethodPut, `{"id":"abc","name":"widgets","epoch":2}`, http.StatusOK)
+	if got := w.Header().Get("Location"); got != "" {
+		t.Errorf("got Location %q on update, want none", got)
+	}
+	do(http.MethodPut, `{"id":"def","name":"gadgets","epoch":1}`, http.StatusCreated)
+}
@@ -4,52 +4,75 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/auth"
 	"github.com/n3wscott/cloudevents-discovery/pkg/background"
+	"github.com/n3wscott/cloudevents-discovery/pkg/logging"
 	"net/http"
+	"strings"
 	"sync"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"go.uber.org/zap"
 )
 
 type SubscriptionHandler struct {
-	once          sync.Once
-	subscriptions map[string]subscription.Subscription
+	store background.SubscriptionStore
+	// writes serializes changes, so a conditional change is made to the
+	// subscription its precondition was checked against, and changes are
+	// vented in the order they were stored.
+	writes sync.Mutex
 
 	changes chan<- background.SubscriptionChange
 }
 
-func NewSubscriptionHandler(changes chan<- background.SubscriptionChange) *SubscriptionHandler {
+func NewSubscriptionHandler(store background.SubscriptionStore, changes chan<- background.SubscriptionChange) *SubscriptionHandler {
 	return &SubscriptionHandler{
+		store:   store,
 		changes: changes,
 	}
 }
 
-// TODO: I made a choice to not implement the OpenAPI of the current api for subscription. I wanted id in the url, not query.
-
-func (h *SubscriptionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.once.Do(func() {
-		h.subscriptions = make(map[string]subscription.Subscription, 0)
+// ExampleSubscriptions returns the example subscriptions used to seed an
+// in-memory store.
+func ExampleSubscriptions() []subscription.Subscription {
+	subscriptions := make([]subscription.Subscription, 0)
+	err := json.Unmarshal([]byte(exampleSubscriptions), &subscriptions)
+	if err != nil {
+		panic(err)
+	}
+	return subscriptions
+}
 
-		subscriptions := make([]subscription.Subscription, 0)
-		err := json.Unmarshal([]byte(exampleSubscriptions), &subscriptions)
-		if err != nil {
-			panic(err)
+// Resume re-emits every stored subscription to the vent as added, so
+// delivery resumes after a restart. Changes made while serving wait for the
+// replay, so the vent never sees a change before the subscription it changes.
+func (h *SubscriptionHandler) Resume() {
+	if h.changes == nil {
+		return
+	}
+	h.writes.Lock()
+	defer h.writes.Unlock()
+	for _, sub := range h.store.All() {
+		h.changes <- background.SubscriptionChange{
+			Change:       "added",
+			Subscription: sub,
 		}
+	}
+}
 
-		for _, sub := range subscriptions {
-			h.subscriptions[sub.ID] = sub
-		}
-	})
+// TODO: I made a choice to not implement the OpenAPI of the current api for subscription. I wanted id in the url, not query.
 
+func (h *SubscriptionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
 	switch r.Method {
 	case http.MethodOptions:
 		if id != "" {
-			w.Header().Set("Allow", "GET,OPTIONS")
+			w.Header().Set("Allow", "GET,DELETE,OPTIONS")
 		} else {
-			w.Header().Set("Allow", "GET,PUT,POST,DELETE,OPTIONS")
+			w.Header().Set("Allow", "GET,PUT,POST,OPTIONS")
 		}
 
 	case http.MethodGet:
@@ -70,7 +93,7 @@ func (h *SubscriptionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		h.handleDelete(id, w, r)
 
 	default:
-		http.Error(w, "", http.StatusInternalServerError)
+		http.Error(w, "", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -100,7 +123,10 @@ func (h *SubscriptionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 //
 // subscription (subscription) - REQUIRED. Realized subscription object.
 // Protocol bindings MAY map the Update and the Create operation into a composite "upsert" operation that creates a new subscription if one with the given id does not exist. In this case, the operation is *Create and follows that operation's rules.
+//
+// If-Match makes an update conditional on the subscription not having changed since it was retrieved.
 func (h *SubscriptionHandler) handleCreateOrUpdate(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	sub := new(subscription.Subscription)
 
 	err := json.NewDecoder(r.Body).Decode(sub)
@@ -109,26 +135,76 @@ func (h *SubscriptionHandler) handleCreateOrUpdate(w http.ResponseWriter, r *htt
 		return
 	}
 
-	var found bool
-	if _, found = h.subscriptions[sub.ID]; found && r.Method == http.MethodPost {
-		http.Error(w, fmt.Sprintf("subscription %q already exists", sub.ID), http.StatusConflict)
+	// The subscription manager assigns an id if one is not proposed.
+	if sub.ID == "" && r.Method == http.MethodPost {
+		sub.ID = uuid.New().String()
+	}
+
+	// Realize the subscription, defaults are applied to the optional settings.
+	if err := sub.Validate(); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if err := sub.SetDefaults(); err != nil {
+		writeInvalid(w, err)
 		return
 	}
 
-	// TODO: validate all of the subscription.
-	if sub.ID == "" {
-		http.Error(w, "", http.StatusBadRequest)
+	// The tenant and owner are recorded by the subscription manager, never
+	// proposed. Ids are unique within the tenant, and only the owner or an
+	// admin may replace a subscription.
+	h.writes.Lock()
+	defer h.writes.Unlock()
+
+	principal := auth.FromContext(r.Context())
+	sub.Tenant = auth.Tenant(r.Context())
+	existing, found := h.store.Get(sub.Tenant, sub.ID)
+	if found && r.Method == http.MethodPost {
+		http.Error(w, fmt.Sprintf("subscription %q already exists", sub.ID), http.StatusConflict)
+		return
+	}
+	if found && !principal.Owns(existing.Owner) {
+		http.Error(w, fmt.Sprintf("subscription %q is owned by another principal", sub.ID), http.StatusForbidden)
+		return
+	}
+	current := ""
+	if found {
+		if current, err = subscriptionETag(existing); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if preconditionFailed(w, r, current) {
+		return
+	}
+	// The principal that created the subscription owns it, so its sink only
+	// receives events about services that principal can see. An admin
+	// replacing another principal's subscription leaves it with its owner.
+	switch {
+	case found && (principal == nil || principal.Name != existing.Owner):
+		sub.Owner, sub.OwnerScopes = existing.Owner, existing.OwnerScopes
+	case principal != nil:
+		sub.Owner, sub.OwnerScopes = principal.Name, principal.Scopes
+	default:
+		sub.Owner, sub.OwnerScopes = "", nil
 	}
 
 	// Save.
-	h.subscriptions[sub.ID] = *sub
+	found, err = h.store.Upsert(*sub)
+	if err != nil {
+		logger.Errorw("failed to save subscription", "subscription", sub.ID, zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	change := "added"
+	if found {
+		change = "updated"
+	}
+	logger.Infow("subscription saved", "subscription", sub.ID, "tenant", sub.Tenant, "change", change, "protocol", sub.Protocol)
 
 	// And vent.
 	if h.changes != nil {
-		change := "added"
-		if found {
-			change = "updated"
-		}
 		h.changes <- background.SubscriptionChange{
 			Change:       change,
 			Subscription: *sub,
@@ -142,7 +218,40 @@ func (h *SubscriptionHandler) handleCreateOrUpdate(w http.ResponseWriter, r *htt
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("ETag", etag(js))
+	if found {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.Header().Set("Location", fmt.Sprintf("/subscriptions/%s", sub.ID))
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(js)
+}
+
+// invalidResponse is the body of a 400 response for an invalid subscription.
+type invalidResponse struct {
+	Error   string                    `json:"error"` // always "invalid"
+	Message string                    `json:"message"`
+	Errors  []subscription.FieldError `json:"errors,omitempty"`
+}
+
+func writeInvalid(w http.ResponseWriter, err error) {
+	resp := invalidResponse{
+		Error:   "invalid",
+		Message: err.Error(),
+	}
+	if verr, ok := err.(*subscription.ValidationError); ok {
+		resp.Errors = verr.Errors
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
 	w.Write(js)
 }
 
@@ -160,13 +269,9 @@ func (h *SubscriptionHandler) handleCreateOrUpdate(w http.ResponseWriter, r *htt
 // ok - the operation succeeded
 // notfound - a subscription with the given id already exists
 func (h *SubscriptionHandler) handleGet(id string, w http.ResponseWriter, r *http.Request) {
-	var sub *subscription.Subscription
-
-	if s, ok := h.subscriptions[id]; ok {
-		sub = &s
-	}
-
-	if sub == nil {
+	// Subscriptions of other principals are not found.
+	sub, found := h.store.Get(auth.Tenant(r.Context()), id)
+	if !found || !auth.FromContext(r.Context()).Owns(sub.Owner) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -177,11 +282,26 @@ func (h *SubscriptionHandler) handleGet(id string, w http.ResponseWriter, r *htt
 		return
 	}
 
+	tag := etag(js)
+	if notModified(w, r, tag) {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", tag)
 	w.WriteHeader(http.StatusOK)
 	w.Write(js)
 }
 
+// subscriptionETag returns the entity tag of the subscription's
+// representation.
+func subscriptionETag(sub subscription.Subscription) (string, error) {
+	js, err := json.Marshal(sub)
+	if err != nil {
+		return "", err
+	}
+	return etag(js), nil
+}
+
 // 3.2.4.3. Querying for a list of Subscriptions
 // The Query operation SHOULD be supported by compliant Event Producers. It allows to query the list of subscriptions on the subscription manager associated with or otherwise visible to the party making the request. If supported, it MUST be supported at the same endpoint as the Create subscription operation.
 //
@@ -196,21 +316,62 @@ func (h *SubscriptionHandler) handleGet(id string, w http.ResponseWriter, r *htt
 // ok - the operation succeeded and returned results
 // nocontent - the operation succeeded and returned no results
 // Protocol bindings and implementations of such bindings MAY add custom filter constraints and pagination arguments as parameters. A request without filtering constraints SHOULD return all available subscriptions associated with or otherwise visible to the party making the request.
+//
+// The protocol and sink query parameters filter the subscriptions. Results are sorted by id, protocol or sink and
+// paginated, see listOptions.
 func (h *SubscriptionHandler) handleQuery(w http.ResponseWriter, r *http.Request) {
-	subscriptions := make([]subscription.Subscription, 0)
+	q := r.URL.Query()
+	opts, err := parseListOptions(q, "id", "protocol", "sink")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	protocol := q.Get("protocol")
+	sink := q.Get("sink")
 
-	// collect
-	for _, sub := range h.subscriptions {
+	principal := auth.FromContext(r.Context())
+	subscriptions := make([]subscription.Subscription, 0)
+	for _, sub := range h.store.List(auth.Tenant(r.Context())) {
+		if !principal.Owns(sub.Owner) {
+			continue
+		}
+		if protocol != "" && !strings.EqualFold(sub.Protocol, protocol) {
+			continue
+		}
+		if sink != "" && sub.Sink.String() != sink {
+			continue
+		}
 		subscriptions = append(subscriptions, sub)
 	}
 
-	js, err := json.Marshal(subscriptions)
+	idx, next := opts.page(len(subscriptions), func(i int) sortKey {
+		switch opts.field {
+		case "protocol":
+			return sortKey{Str: subscriptions[i].Protocol, ID: subscriptions[i].ID}
+		case "sink":
+			return sortKey{Str: subscriptions[i].Sink.String(), ID: subscriptions[i].ID}
+		}
+		return sortKey{ID: subscriptions[i].ID}
+	})
+	page := make([]subscription.Subscription, 0, len(idx))
+	for _, i := range idx {
+		page = append(page, subscriptions[i])
+	}
+
+	js, err := json.Marshal(page)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	tag := etag(js)
+	if notModified(w, r, tag) {
+		return
+	}
+	setNextLink(w, r, next)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", tag)
 	w.WriteHeader(http.StatusOK)
 	w.Write(js)
 }
@@ -228,25 +389,52 @@ func (h *SubscriptionHandler) handleQuery(w http.ResponseWriter, r *http.Request
 //
 // ok - the operation succeeded
 // notfound - a subscription with the given id already exists // TODO: fix this in the spec upstream. Should be: _does not_ already exist.
+//
+// If-Match makes the delete conditional on the subscription not having changed since it was retrieved.
 func (h *SubscriptionHandler) handleDelete(id string, w http.ResponseWriter, r *http.Request) {
 	if id == "" {
 		http.Error(w, fmt.Sprintf("subscription %q not found", id), http.StatusNotFound)
 		return
 	}
 
-	if _, found := h.subscriptions[id]; !found {
+	h.writes.Lock()
+	defer h.writes.Unlock()
+
+	// Subscriptions of other principals are not found.
+	tenant := auth.Tenant(r.Context())
+	sub, found := h.store.Get(tenant, id)
+	if !found || !auth.FromContext(r.Context()).Owns(sub.Owner) {
+		http.Error(w, fmt.Sprintf("subscription %q not found", id), http.StatusNotFound)
+		return
+	}
+	current, err := subscriptionETag(sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if preconditionFailed(w, r, current) {
+		return
+	}
+
+	old, found, err := h.store.Delete(tenant, id)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorw("failed to delete subscription", "subscription", id, zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
 		http.Error(w, fmt.Sprintf("subscription %q not found", id), http.StatusNotFound)
 		return
 	}
+	logging.FromContext(r.Context()).Infow("subscription deleted", "subscription", id, "tenant", old.Tenant)
 
 	// And vent.
 	if h.changes != nil {
 		h.changes <- background.SubscriptionChange{
 			Change:       "deleted",
-			Subscription: h.subscriptions[id],
+			Subscription: old,
 		}
 	}
 
-	delete(h.subscriptions, id)
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/subscription"
+	"github.com/n3wscott/cloudevents-discovery/pkg/auth"
+	"github.com/n3wscott/cloudevents-discovery/pkg/background"
+	"github.com/n3wscott/cloudevents-discovery/pkg/logging"
+)
+
+// recorder is an HTTP sink that records the events it receives.
+type recorder struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	events []cloudevents.Event
+}
+
+func newRecorder(t *testing.T) *recorder {
+	rec := new(recorder)
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := binding.ToEvent(r.Context(), cehttp.NewMessageFromHttpRequest(r))
+		if err != nil {
+			t.Errorf("sink received an invalid event: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rec.mu.Lock()
+		rec.events = append(rec.events, *event)
+		rec.mu.Unlock()
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+// types returns the types of the recorded events, waiting until there are n.
+func (rec *recorder) types(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec.mu.Lock()
+		got := make([]string, 0, len(rec.events))
+		for _, e := range rec.events {
+			got = append(got, strings.TrimPrefix(e.Type(), "cloudmeta.discovery."))
+		}
+		rec.mu.Unlock()
+		if len(got) >= n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sequences returns the sequence extensions of the recorded events.
+func (rec *recorder) sequences() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	seqs := make([]string, 0, len(rec.events))
+	for _, e := range rec.events {
+		seq, _ := e.Extensions()["sequence"].(string)
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// lifecycle is a subscription handler wired to a running vent.
+type lifecycle struct {
+	store  background.ServiceStore
+	router *mux.Router
+}
+
+func newLifecycle(t *testing.T) *lifecycle {
+	store := background.NewServiceStore()
+	subs := make(chan background.SubscriptionChange, 10)
+	vent, err := background.NewVent("http://cloudmeta.test", "", background.DeliveryConfig{MaxAttempts: 1}, store.Watch(), subs, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vent.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	h := NewSubscriptionHandler(background.NewSubscriptionStore(), subs)
+	r := mux.NewRouter()
+	r.Handle("/subscriptions", h)
+	r.Handle("/subscriptions/{id}", h)
+	return &lifecycle{store: store, router: r}
+}
+
+func (l *lifecycle) do(t *testing.T, method, target, body string, want int) {
+	t.Helper()
+	l.doAs(t, nil, method, target, body, want)
+}
+
+// doAs makes the request as the principal, nil for a server without
+// authentication.
+func (l *lifecycle) doAs(t *testing.T, p *auth.Principal, method, target, body string, want int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	ctx := logging.WithLogger(r.Context(), zap.NewNop().Sugar())
+	if p != nil {
+		ctx = auth.WithPrincipal(ctx, p)
+	}
+	r = r.WithContext(ctx)
+	l.router.ServeHTTP(w, r)
+	if w.Code != want {
+		t.Fatalf("%s %s: got %d, want %d: %s", method, target, w.Code, want, w.Body.String())
+	}
+}
+
+func (l *lifecycle) changeService(t *testing.T, epoch int) {
+	t.Helper()
+	if err := l.store.Upsert(context.Background(), discovery.Service{ID: "svc", Name: "svc", Epoch: epoch}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	l := newLifecycle(t)
+	first := newRecorder(t)
+	second := newRecorder(t)
+	sub := func(sink, method string) string {
+		return fmt.Sprintf(`{"id":"sub","protocol":"HTTP","sink":%q,"protocolsettings":{"method":%q}}`, sink, method)
+	}
+
+	// Create starts the stream.
+	l.do(t, http.MethodPost, "/subscriptions", sub(first.URL, "POST"), http.StatusCreated)
+	if got := first.types(t, 1); len(got) != 1 || got[0] != "service.subscribed.v1" {
+		t.Fatalf("after create got %v, want [service.subscribed.v1]", got)
+	}
+	l.changeService(t, 1)
+
+	// Updating the subscription but keeping the sink continues the stream,
+	// in order.
+	l.do(t, http.MethodPut, "/subscriptions", sub(first.URL, "PUT"), http.StatusOK)
+	l.changeService(t, 2)
+	want := []string{"service.subscribed.v1", "service.added.v1", "service.updated.v1"}
+	if got := first.types(t, 3); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("after update got %v, want %v", got, want)
+	}
+	if got := first.sequences(); strings.Join(got, ",") != "1,2,3" {
+		t.Errorf("got sequences %v, want [1 2 3]", got)
+	}
+
+	// Moving to a new sink ends the stream on the old sink and starts one on
+	// the new sink.
+	l.do(t, http.MethodPut, "/subscriptions", sub(second.URL, "POST"), http.StatusOK)
+	if got := first.types(t, 4); len(got) != 4 || got[3] != "service.unsubscribed.v1" {
+		t.Fatalf("after moving got %v on the old sink, want it to end with service.unsubscribed.v1", got)
+	}
+	if got := second.types(t, 1); len(got) != 1 || got[0] != "service.subscribed.v1" {
+		t.Fatalf("after moving got %v on the new sink, want [service.subscribed.v1]", got)
+	}
+
+	// Delete ends the stream.
+	l.do(t, http.MethodDelete, "/subscriptions/sub", "", http.StatusOK)
+	want = []string{"service.subscribed.v1", "service.unsubscribed.v1"}
+	if got := second.types(t, 2); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("after delete got %v, want %v", got, want)
+	}
+	l.do(t, http.MethodGet, "/subscriptions/sub", "", http.StatusNotFound)
+}
+
+func TestSubscriptionUpdateKeepsOrder(t *testing.T) {
+	l := newLifecycle(t)
+	sink := newRecorder(t)
+	body := fmt.Sprintf(`{"id":"sub","protocol":"HTTP","sink":%q}`, sink.URL)
+
+	l.do(t, http.MethodPost, "/subscriptions", body, http.StatusCreated)
+	sink.types(t, 1)
+	for epoch := 1; epoch <= 20; epoch++ {
+		l.changeService(t, epoch)
+		if epoch%5 == 0 {
+			l.do(t, http.MethodPut, "/subscriptions", body, http.StatusOK)
+		}
+	}
+
+	sink.types(t, 21)
+	seqs := sink.sequences()
+	if len(seqs) != 21 {
+		t.Fatalf("got %d events, want 21", len(seqs))
+	}
+	for i, seq := range seqs {
+		if want := fmt.Sprint(i + 1); seq != want {
+			t.Fatalf("event %d has sequence %s, want %s: %v", i, seq, want, seqs)
+		}
+	}
+}
+
+func TestSubscriptionAdminKeepsOwner(t *testing.T) {
+	l := newLifecycle(t)
+	sink := newRecorder(t)
+	alice := &auth.Principal{Name: "alice", Scopes: []string{"team-a"}, Tenant: "acme"}
+	bob := &auth.Principal{Name: "bob", Tenant: "acme"}
+	root := &auth.Principal{Name: "root", Scopes: []string{auth.AdminScope}, Tenant: "acme"}
+	sub := fmt.Sprintf(`{"id":"sub","protocol":"HTTP","sink":%q}`, sink.URL)
+
+	l.doAs(t, alice, http.MethodPost, "/subscriptions", sub, http.StatusCreated)
+	l.doAs(t, bob, http.MethodGet, "/subscriptions/sub", "", http.StatusNotFound)
+	l.doAs(t, bob, http.MethodPut, "/subscriptions", sub, http.StatusForbidden)
+
+	// An admin edits the subscription, which stays with its owner.
+	l.doAs(t, root, http.MethodPut, "/subscriptions", sub, http.StatusOK)
+	l.doAs(t, root, http.MethodGet, "/subscriptions/sub", "", http.StatusOK)
+	l.doAs(t, alice, http.MethodGet, "/subscriptions/sub", "", http.StatusOK)
+	l.doAs(t, alice, http.MethodPut, "/subscriptions", sub, http.StatusOK)
+	l.doAs(t, alice, http.MethodDelete, "/subscriptions/sub", "", http.StatusOK)
+}
+
+func TestExampleSubscriptionsValid(t *testing.T) {
+	for _, sub := range ExampleSubscriptions() {
+		if err := sub.Validate(); err != nil {
+			t.Errorf("example %s: %v", sub.ID, err)
+		}
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	for name, resource := range conditionals() {
+		t.Run(name, func(t *testing.T) {
+			c := resource()
+			c.do(t, http.MethodPost, c.collection, c.body(1), http.StatusCreated)
+			item := c.collection + "/x"
+
+			// OPTIONS lists what each path serves, and the rest are not
+			// allowed.
+			for target, tc := range map[string]struct {
+				allow      string
+				disallowed []string
+			}{
+				c.collection: {allow: "GET,PUT,POST,OPTIONS", disallowed: []string{http.MethodPatch}},
+				item:         {allow: "GET,DELETE,OPTIONS", disallowed: []string{http.MethodPut, http.MethodPost, http.MethodPatch}},
+			} {
+				w := c.do(t, http.MethodOptions, target, "", http.StatusOK)
+				if got := w.Header().Get("Allow"); got != tc.allow {
+					t.Errorf("OPTIONS %s: got Allow %q, want %q", target, got, tc.allow)
+				}
+				for _, method := range tc.disallowed {
+					c.do(t, method, target, c.body(2), http.StatusMethodNotAllowed)
+				}
+			}
+			c.do(t, http.MethodGet, c.collection, "", http.StatusOK)
+			c.do(t, http.MethodPut, c.collection, c.body(2), http.StatusOK)
+			c.do(t, http.MethodGet, item, "", http.StatusOK)
+			c.do(t, http.MethodDelete, item, "", http.StatusOK)
+		})
+	}
+}
+
+func TestSubscriptionInvalid(t *testing.T) {
+	c := conditionals()["subscriptions"]()
+	w := c.do(t, http.MethodPost, c.collection, `{"id":"x","protocol":"SMTP","sink":"mailto:ops@example.com","filter":{"dialect":"regex"}}`, http.StatusBadRequest)
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+	var resp invalidResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	fields := make([]string, 0, len(resp.Errors))
+	for _, fe := range resp.Errors {
+		fields = append(fields, fe.Field)
+	}
+	if resp.Error != "invalid" || strings.Join(fields, ",") != "protocol,sink,filter.dialect" {
+		t.Errorf("got error %q with fields %v", resp.Error, fields)
+	}
+	// Nothing is saved.
+	c.do(t, http.MethodGet, c.collection+"/x", "", http.StatusNotFound)
+}
+
+func TestSubscriptionAssignedID(t *testing.T) {
+	c := conditionals()["subscriptions"]()
+	w := c.do(t, http.MethodPost, c.collection, `{"protocol":"HTTP","sink":"http://sink.test"}`, http.StatusCreated)
+	var realized subscription.Subscription
+	if err := json.Unmarshal(w.Body.Bytes(), &realized); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uuid.Parse(realized.ID); err != nil {
+		t.Fatalf("got id %q, want a uuid: %v", realized.ID, err)
+	}
+	location := w.Header().Get("Location")
+	if location != "/subscriptions/"+realized.ID {
+		t.Errorf("got Location %q for id %s", location, realized.ID)
+	}
+	if realized.ProtocolSettings == nil || string(*realized.ProtocolSettings) != `{"method":"POST"}` {
+		t.Errorf("got realized protocol settings %v, want the default method", realized.ProtocolSettings)
+	}
+	if got := c.do(t, http.MethodGet, location, "", http.StatusOK).Body.String(); got != w.Body.String() {
+		t.Errorf("got %s, want the realized subscription %s", got, w.Body.String())
+	}
+
+	// Each subscription gets its own id, but an update must name one.
+	again := c.do(t, http.MethodPost, c.collection, `{"protocol":"HTTP","sink":"http://sink.test"}`, http.StatusCreated)
+	if again.Header().Get("Location") == location {
+		t.Error("assigned the same id twice")
+	}
+	c.do(t, http.MethodPut, c.collection, `{"protocol":"HTTP","sink":"http://sink.test"}`, http.StatusBadRequest)
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/apis/discovery"
+)
+
+// TypesHandler serves an index of every event type produced by the services
+// known to a ServicesHandler.
+type TypesHandler struct {
+	services *ServicesHandler
+}
+
+func NewTypesHandler(services *ServicesHandler) *TypesHandler {
+	return &TypesHandler{
+		services: services,
+	}
+}
+
+// -- HTTP --
+
+func (h *TypesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	t := vars["type"]
+	if t == "" {
+		h.handleList(w, r)
+	} else {
+		h.handleGet(t, w, r)
+	}
+}
+
+// GetTypes indexes the events of the services visible to the context's
+// principal by type, sorted by type.
+func (h *TypesHandler) GetTypes(ctx context.Context) []discovery.Type {
+	index := make(map[string]*discovery.Type)
+	for _, svc := range h.services.visibleServices(ctx) {
+		for _, event := range svc.Events {
+			t, ok := index[event.Type]
+			if !ok {
+				t = &discovery.Type{
+					Type:     event.Type,
+					Services: make([]discovery.TypeService, 0),
+				}
+				index[event.Type] = t
+			}
+			t.Services = append(t.Services, discovery.TypeService{
+				ID:    svc.ID,
+				URL:   svc.URL,
+				Name:  svc.Name,
+				Event: event,
+			})
+		}
+	}
+
+	types := make([]discovery.Type, 0, len(index))
+	for _, t := range index {
+		types = append(types, *t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].Type < types[j].Type
+	})
+	return types
+}
+
+func (h *TypesHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	types := h.GetTypes(r.Context())
+
+	// Check to see if there is a filter.
+	matching := strings.ToLower(r.URL.Query().Get("matching"))
+	prefix := r.URL.Query().Get("prefix")
+	if matching != "" || prefix != "" {
+		filtered := make([]discovery.Type, 0)
+		for _, t := range types {
+			if matching != "" && !strings.Contains(strings.ToLower(t.Type), matching) {
+				continue
+			}
+			if prefix != "" && !strings.HasPrefix(t.Type, prefix) {
+				continue
+			}
+			filtered = append(filtered, t)
+		}
+		types = filtered
+	}
+
+	js, err := json.Marshal(types)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+func (h *TypesHandler) handleGet(t string, w http.ResponseWriter, r *http.Request) {
+	var found *discovery.Type
+
+	for _, v := range h.GetTypes(r.Context()) {
+		if v.Type == t {
+			found = &v
+			break
+		}
+	}
+
+	if found == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(found)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
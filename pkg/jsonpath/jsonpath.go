@@ -0,0 +1,194 @@
+// Package jsonpath selects values from decoded JSON documents with a subset of
+// JSONPath, e.g.
+//
+//	$.service.name
+//	$.service.protocols[*]
+//	$['service']['events'][0].type
+//	$..type
+//
+// Supported are the root $, child names with dot or bracket notation, array
+// indexes (negative counts from the end), the wildcard * and recursive
+// descent with .. .
+package jsonpath
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path is a parsed JSONPath expression. It is safe for concurrent use.
+type Path struct {
+	src      string
+	segments []segment
+}
+
+// segment selects children of a value, from the value itself when recursive
+// is false, or from the value and all its descendants when true.
+type segment struct {
+	recursive bool
+	wildcard  bool
+	name      *string
+	index     *int
+}
+
+// Parse parses the expression, which must start with $.
+func Parse(src string) (*Path, error) {
+	s := strings.TrimSpace(src)
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("jsonpath: %q must start with $", src)
+	}
+	p := &Path{src: src, segments: make([]segment, 0)}
+	for i := 1; i < len(s); {
+		var seg segment
+		var err error
+		switch {
+		case strings.HasPrefix(s[i:], ".."):
+			seg.recursive = true
+			i += 2
+			if i < len(s) && s[i] == '[' {
+				i, err = parseBracket(s, i, &seg)
+			} else {
+				i, err = parseDot(s, i, &seg)
+			}
+		case s[i] == '.':
+			i, err = parseDot(s, i+1, &seg)
+		case s[i] == '[':
+			i, err = parseBracket(s, i, &seg)
+		default:
+			err = fmt.Errorf("unexpected %q at position %d", s[i], i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jsonpath: %q: %v", src, err)
+		}
+		p.segments = append(p.segments, seg)
+	}
+	return p, nil
+}
+
+// parseDot parses a name or * following a dot, starting at i.
+func parseDot(s string, i int, seg *segment) (int, error) {
+	if i < len(s) && s[i] == '*' {
+		seg.wildcard = true
+		return i + 1, nil
+	}
+	start := i
+	for i < len(s) && s[i] != '.' && s[i] != '[' {
+		i++
+	}
+	if i == start {
+		return 0, fmt.Errorf("expected a name at position %d", start)
+	}
+	name := s[start:i]
+	seg.name = &name
+	return i, nil
+}
+
+// parseBracket parses [*], [index], ['name'] or ["name"] starting at the
+// opening bracket i.
+func parseBracket(s string, i int, seg *segment) (int, error) {
+	end := strings.IndexByte(s[i:], ']')
+	if end < 0 {
+		return 0, fmt.Errorf("unterminated [ at position %d", i)
+	}
+	inner := strings.TrimSpace(s[i+1 : i+end])
+	next := i + end + 1
+
+	switch {
+	case inner == "*":
+		seg.wildcard = true
+	case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+		name := inner[1 : len(inner)-1]
+		seg.name = &name
+	default:
+		idx, err := strconv.Atoi(inner)
+		if err != nil {
+			return 0, fmt.Errorf("invalid selector [%s] at position %d", inner, i)
+		}
+		seg.index = &idx
+	}
+	return next, nil
+}
+
+func (p *Path) String() string {
+	return p.src
+}
+
+// Select returns the values selected from the document, a value decoded by
+// encoding/json into an interface{}. Returns no values if nothing matches.
+func (p *Path) Select(doc interface{}) []interface{} {
+	selected := []interface{}{doc}
+	for _, seg := range p.segments {
+		next := make([]interface{}, 0)
+		for _, v := range selected {
+			if seg.recursive {
+				for _, d := range descendants(v) {
+					next = append(next, seg.children(d)...)
+				}
+			} else {
+				next = append(next, seg.children(v)...)
+			}
+		}
+		selected = next
+	}
+	return selected
+}
+
+func (seg segment) children(v interface{}) []interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if seg.wildcard {
+			return values(t)
+		}
+		if seg.name != nil {
+			if c, ok := t[*seg.name]; ok {
+				return []interface{}{c}
+			}
+		}
+	case []interface{}:
+		if seg.wildcard {
+			return t
+		}
+		if seg.index != nil {
+			i := *seg.index
+			if i < 0 {
+				i += len(t)
+			}
+			if i >= 0 && i < len(t) {
+				return []interface{}{t[i]}
+			}
+		}
+	}
+	return nil
+}
+
+// descendants returns v and every value nested in it.
+func descendants(v interface{}) []interface{} {
+	all := []interface{}{v}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, c := range values(t) {
+			all = append(all, descendants(c)...)
+		}
+	case []interface{}:
+		for _, c := range t {
+			all = append(all, descendants(c)...)
+		}
+	}
+	return all
+}
+
+// values returns the map's values ordered by key, so selections are stable.
+func values(m map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	vs := make([]interface{}, 0, len(m))
+	for _, k := range keys {
+		vs = append(vs, m[k])
+	}
+	return vs
+}
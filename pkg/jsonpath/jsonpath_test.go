@@ -0,0 +1,53 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+const doc = `{
+	"change": "added",
+	"service": {
+		"name": "widgets",
+		"epoch": 3,
+		"protocols": ["HTTP", "KAFKA"],
+		"events": [{"type": "com.example.widget.created"}, {"type": "com.example.widget.deleted"}]
+	}
+}`
+
+func TestSelect(t *testing.T) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"$.change":                       "[added]",
+		"$.service.name":                 "[widgets]",
+		"$.service.epoch":                "[3]",
+		"$.service.protocols[*]":         "[HTTP KAFKA]",
+		"$.service.protocols[-1]":        "[KAFKA]",
+		"$['service']['events'][0].type": "[com.example.widget.created]",
+		"$..type":                        "[com.example.widget.created com.example.widget.deleted]",
+		"$.service.missing":              "[]",
+		"$.service.protocols[5]":         "[]",
+	}
+	for path, want := range tests {
+		p, err := Parse(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if got := fmt.Sprint(p.Select(v)); got != want {
+			t.Errorf("%s: got %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, path := range []string{"", "service.name", "$.service[", "$.service[name]", "$service"} {
+		if _, err := Parse(path); err == nil {
+			t.Errorf("%q: parsed, want an error", path)
+		}
+	}
+}
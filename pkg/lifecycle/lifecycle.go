@@ -0,0 +1,152 @@
+// Package lifecycle runs the server's components until the process is asked
+// to stop, then stops them in order within a deadline.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/n3wscott/cloudevents-discovery/pkg/background"
+	"go.uber.org/zap"
+)
+
+// Manager starts components and stops them in the reverse order they were
+// started, so the HTTP server stops accepting changes before the workers
+// that consume them.
+type Manager struct {
+	timeout    time.Duration
+	logger     *zap.SugaredLogger
+	components []*component
+	exited     chan *component
+}
+
+type component struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// NewManager returns a manager that allows timeout for all components to stop.
+func NewManager(timeout time.Duration, logger *zap.SugaredLogger) *Manager {
+	return &Manager{
+		timeout: timeout,
+		logger:  logger,
+		exited:  make(chan *component, 1),
+	}
+}
+
+// Start runs the component in the background until Wait stops it.
+func (m *Manager) Start(name string, bg background.Background) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &component{
+		name:   name,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.components = append(m.components, c)
+
+	go func() {
+		defer close(c.done)
+		c.err = bg.Start(ctx)
+		if ctx.Err() == nil {
+			// Exited on its own.
+			select {
+			case m.exited <- c:
+			default:
+			}
+		}
+	}()
+}
+
+// StartServer runs the HTTP server until Wait stops it, in-flight requests
+// are given the manager's timeout to complete. The server serves TLS if it
+// has a TLSConfig, which must hold its certificate.
+func (m *Manager) StartServer(name string, srv *http.Server) {
+	m.Start(name, &server{srv: srv, timeout: m.timeout})
+}
+
+// Wait blocks until ctx is done, SIGINT or SIGTERM is received or a component
+// exits on its own, then stops every component. Returns an error naming the
+// components that failed or did not stop within the timeout.
+func (m *Manager) Wait(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+		m.logger.Infow("shutting down", "cause", context.Cause(ctx).Error())
+	case c := <-m.exited:
+		m.logger.Errorw("shutting down, component exited", "component", c.name, zap.Error(c.err))
+	}
+	return m.stop()
+}
+
+func (m *Manager) stop() error {
+	deadline := time.NewTimer(m.timeout)
+	defer deadline.Stop()
+
+	failed := make([]string, 0)
+	for i := len(m.components) - 1; i >= 0; i-- {
+		c := m.components[i]
+		c.cancel()
+		select {
+		case <-c.done:
+			if c.err != nil && !errors.Is(c.err, context.Canceled) {
+				m.logger.Errorw("component failed to stop", "component", c.name, zap.Error(c.err))
+				failed = append(failed, fmt.Sprintf("%s: %v", c.name, c.err))
+			} else {
+				m.logger.Infow("component stopped", "component", c.name)
+			}
+		case <-deadline.C:
+			// Out of time, report this and every component not yet stopped.
+			for ; i >= 0; i-- {
+				m.components[i].cancel()
+				m.logger.Errorw("component did not stop in time", "component", m.components[i].name, "timeout", m.timeout)
+				failed = append(failed, fmt.Sprintf("%s: did not stop within %s", m.components[i].name, m.timeout))
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to stop cleanly: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// server adapts an http.Server to a background.Background.
+type server struct {
+	srv     *http.Server
+	timeout time.Duration
+}
+
+func (s *server) Start(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		if s.srv.TLSConfig != nil {
+			errs <- s.srv.ListenAndServeTLS("", "")
+			return
+		}
+		errs <- s.srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdown); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
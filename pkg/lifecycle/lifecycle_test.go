@@ -0,0 +1,134 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// backgroundFunc adapts a function to a background.Background.
+type backgroundFunc func(ctx context.Context) error
+
+func (f backgroundFunc) Start(ctx context.Context) error {
+	return f(ctx)
+}
+
+// stopOrder records the order components stop in.
+type stopOrder struct {
+	mu      sync.Mutex
+	stopped []string
+}
+
+// component runs until canceled, then records it stopped.
+func (o *stopOrder) component(name string) backgroundFunc {
+	return func(ctx context.Context) error {
+		<-ctx.Done()
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.stopped = append(o.stopped, name)
+		return ctx.Err()
+	}
+}
+
+func (o *stopOrder) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.stopped, ",")
+}
+
+func TestWaitStopsInReverseOrder(t *testing.T) {
+	m := NewManager(5*time.Second, zap.NewNop().Sugar())
+	order := new(stopOrder)
+	for _, name := range []string{"aggregation", "vent", "server"} {
+		m.Start(name, order.component(name))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := order.String(); got != "server,vent,aggregation" {
+		t.Errorf("stopped %s, want server,vent,aggregation", got)
+	}
+}
+
+func TestWaitComponentExits(t *testing.T) {
+	m := NewManager(5*time.Second, zap.NewNop().Sugar())
+	order := new(stopOrder)
+	m.Start("vent", order.component("vent"))
+	m.Start("aggregation", backgroundFunc(func(context.Context) error {
+		return errors.New("downstream gone")
+	}))
+
+	// The exit stops the rest without ctx being done.
+	err := m.Wait(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "aggregation: downstream gone") {
+		t.Errorf("got %v, want the aggregation's error", err)
+	}
+	if got := order.String(); got != "vent" {
+		t.Errorf("stopped %q, want vent", got)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	m := NewManager(50*time.Millisecond, zap.NewNop().Sugar())
+	order := new(stopOrder)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	m.Start("vent", order.component("vent"))
+	m.Start("aggregation", backgroundFunc(func(context.Context) error {
+		<-stuck
+		return nil
+	}))
+	m.Start("server", order.component("server"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	err := m.Wait(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stopped after %s, want the timeout", elapsed)
+	}
+	// The stuck component and those after it in the stop order are reported.
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for name, want := range map[string]bool{"server": false, "aggregation": true, "vent": true} {
+		if got := strings.Contains(err.Error(), name+": did not stop"); got != want {
+			t.Errorf("%v: reported %s %t, want %t", err, name, got, want)
+		}
+	}
+	// Every component was canceled, so vent stops even though it was out of
+	// time.
+	deadline := time.Now().Add(5 * time.Second)
+	for order.String() != "server,vent" {
+		if time.Now().After(deadline) {
+			t.Fatalf("stopped %s, want server,vent", order.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartServer(t *testing.T) {
+	m := NewManager(5*time.Second, zap.NewNop().Sugar())
+	m.StartServer("server", &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A server that cannot listen exits on its own.
+	m = NewManager(5*time.Second, zap.NewNop().Sugar())
+	m.StartServer("server", &http.Server{Addr: "127.0.0.1:-1"})
+	if err := m.Wait(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "failed to stop cleanly: server: ") {
+		t.Errorf("got %v, want the server's listen error", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Package logging builds the server's structured logger and carries it in
+// request contexts, tagged with a request id.
+package logging
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RequestIDHeader is read for the id of incoming requests and set on the
+// response. An id is generated if the request has none.
+const RequestIDHeader = "X-Request-Id"
+
+// New returns a JSON logger at the given level: debug, info, warn or error.
+func New(level string) (*zap.SugaredLogger, error) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(l)
+	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return logger.Sugar(), nil
+}
+
+// WithLogger returns a context carrying the logger. The CloudEvents SDK logs
+// with it too.
+func WithLogger(ctx context.Context, logger *zap.SugaredLogger) context.Context {
+	return cecontext.WithLogger(ctx, logger)
+}
+
+// FromContext returns the context's logger, or the SDK's default logger.
+func FromContext(ctx context.Context) *zap.SugaredLogger {
+	return cecontext.LoggerFrom(ctx)
+}
+
+// Middleware logs every request and puts a logger tagged with the request id
+// in the request context, for handlers to get with FromContext.
+func Middleware(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if id == "" {
+				id = uuid.New().String()
+			}
+			w.Header().Set(RequestIDHeader, id)
+
+			reqLogger := logger.With("requestid", id)
+			rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			next.ServeHTTP(rw, r.WithContext(WithLogger(r.Context(), reqLogger)))
+
+			reqLogger.Infow("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rw.status,
+				"duration", time.Since(start))
+		})
+	}
+}
+
+// statusWriter records the response status for the request log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
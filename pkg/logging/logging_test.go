@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNew(t *testing.T) {
+	for level, valid := range map[string]bool{
+		"debug":   true,
+		"info":    true,
+		"WARN":    true,
+		"error":   true,
+		"":        true,
+		"verbose": false,
+	} {
+		logger, err := New(level)
+		if (err == nil) != valid {
+			t.Errorf("level %q: got %v, want valid %t", level, err, valid)
+		}
+		if err != nil {
+			continue
+		}
+		if debug := logger.Desugar().Core().Enabled(zapcore.DebugLevel); debug != (level == "debug") {
+			t.Errorf("level %q: got debug enabled %t", level, debug)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	h := Middleware(zap.New(core).Sugar())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Infow("handling", "subscription", "sub")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := map[string]struct {
+		requestID string
+	}{
+		"generated id": {},
+		"given id":     {requestID: "abc-123"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			logs.TakeAll()
+			r := httptest.NewRequest(http.MethodPut, "/subscriptions", nil)
+			if tc.requestID != "" {
+				r.Header.Set(RequestIDHeader, tc.requestID)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			id := w.Header().Get(RequestIDHeader)
+			if tc.requestID != "" && id != tc.requestID {
+				t.Errorf("got request id %q, want %q", id, tc.requestID)
+			}
+			if _, err := uuid.Parse(id); tc.requestID == "" && err != nil {
+				t.Errorf("got request id %q, want a uuid", id)
+			}
+
+			// The handler's log and the request log are tagged with the id.
+			entries := logs.TakeAll()
+			if len(entries) != 2 {
+				t.Fatalf("got %d log entries, want 2", len(entries))
+			}
+			for _, e := range entries {
+				if got := e.ContextMap()["requestid"]; got != id {
+					t.Errorf("%q logged with request id %v, want %s", e.Message, got, id)
+				}
+			}
+			if got := entries[0].ContextMap()["subscription"]; got != "sub" {
+				t.Errorf("handler logged subscription %v", got)
+			}
+			fields := entries[1].ContextMap()
+			if entries[1].Message != "request" || fields["method"] != http.MethodPut || fields["path"] != "/subscriptions" || fields["status"] != int64(http.StatusTeapot) {
+				t.Errorf("got request log %q %v", entries[1].Message, fields)
+			}
+		})
+	}
+}
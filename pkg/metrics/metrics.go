@@ -0,0 +1,153 @@
+// Package metrics holds the server's Prometheus metrics, served by Handler.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cloudmeta"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// AggregationPulls counts pulls from each downstream by result, "ok" or
+	// "error".
+	AggregationPulls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "aggregation",
+		Name:      "pulls_total",
+		Help:      "Pulls from downstream discovery services by downstream url and result.",
+	}, []string{"downstream", "result"})
+
+	// AggregationPullDuration observes the latency of pulls from each downstream.
+	AggregationPullDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "aggregation",
+		Name:      "pull_duration_seconds",
+		Help:      "Latency of pulls from downstream discovery services by downstream url.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"downstream"})
+
+	// AggregationEvents counts events received from each downstream's
+	// subscription by event type.
+	AggregationEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "aggregation",
+		Name:      "events_total",
+		Help:      "Events received from downstream discovery services by downstream url and event type.",
+	}, []string{"downstream", "type"})
+
+	// AggregationResyncs counts full resyncs with each downstream by reason:
+	// "startup", "subscribed", "gap", "unsubscribed" or "period".
+	AggregationResyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "aggregation",
+		Name:      "resyncs_total",
+		Help:      "Full resyncs with downstream discovery services by downstream url and reason.",
+	}, []string{"downstream", "reason"})
+
+	// Services is the number of registered services.
+	Services = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services",
+		Help:      "Number of registered services.",
+	})
+
+	// ServiceChanges counts services added, updated and deleted.
+	ServiceChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_changes_total",
+		Help:      "Service changes by change: added, updated or deleted.",
+	}, []string{"change"})
+
+	// DeliveryAttempts counts attempts to deliver an event to a sink by
+	// protocol and result, "ok" or "error".
+	DeliveryAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "delivery",
+		Name:      "attempts_total",
+		Help:      "Event delivery attempts by subscription protocol and result.",
+	}, []string{"protocol", "result"})
+
+	// DeliveryDuration observes the latency of each delivery attempt.
+	DeliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "delivery",
+		Name:      "attempt_duration_seconds",
+		Help:      "Event delivery attempt latency by subscription protocol.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"protocol"})
+
+	// DeliveryFailures counts events that could not be delivered and were
+	// dead-lettered, by protocol.
+	DeliveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "delivery",
+		Name:      "failures_total",
+		Help:      "Events that exhausted their delivery attempts or did not fit the queue, by subscription protocol.",
+	}, []string{"protocol"})
+)
+
+// Result is the result label for err.
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Handler serves the metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware counts and times requests, labeled with the mux route template
+// so ids in paths do not create new series.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rw, r)
+
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rw.status)).Inc()
+	})
+}
+
+// statusWriter records the response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
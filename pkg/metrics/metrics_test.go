@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResult(t *testing.T) {
+	if got := Result(nil); got != "ok" {
+		t.Errorf("got %q for no error, want ok", got)
+	}
+	if got := Result(errors.New("refused")); got != "error" {
+		t.Errorf("got %q for an error, want error", got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			http.NotFound(w, r)
+		}
+	})
+
+	requests := func(route, method, code string) float64 {
+		return testutil.ToFloat64(httpRequests.WithLabelValues(route, method, code))
+	}
+	ok := requests("/subscriptions/{id}", http.MethodGet, "200")
+	missing := requests("/subscriptions/{id}", http.MethodGet, "404")
+
+	// Requests are labeled by route template, not path.
+	for _, path := range []string{"/subscriptions/a", "/subscriptions/b", "/subscriptions/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := requests("/subscriptions/{id}", http.MethodGet, "200") - ok; got != 2 {
+		t.Errorf("counted %v ok requests, want 2", got)
+	}
+	if got := requests("/subscriptions/{id}", http.MethodGet, "404") - missing; got != 1 {
+		t.Errorf("counted %v not found requests, want 1", got)
+	}
+	for _, path := range []string{"/subscriptions/a", "/subscriptions/missing"} {
+		if got := testutil.ToFloat64(httpRequests.WithLabelValues(path, http.MethodGet, "200")); got != 0 {
+			t.Errorf("counted %v requests labeled with the path %s", got, path)
+		}
+	}
+
+	// Outside a router the route is unknown.
+	unknown := requests("unknown", http.MethodPost, "404")
+	Middleware(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/x", nil))
+	if got := requests("unknown", http.MethodPost, "404") - unknown; got != 1 {
+		t.Errorf("counted %v unknown route requests, want 1", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ServiceChanges.WithLabelValues("added").Inc()
+	DeliveryAttempts.WithLabelValues("HTTP", Result(nil)).Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", w.Code)
+	}
+	for _, want := range []string{
+		`cloudmeta_service_changes_total{change="added"}`,
+		`cloudmeta_delivery_attempts_total{protocol="HTTP",result="ok"}`,
+		"cloudmeta_services ",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics do not include %s", want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package tracing sets up OpenTelemetry tracing and propagates W3C trace
+// context over HTTP and in CloudEvents, using the distributed tracing
+// extension's traceparent and tracestate attributes.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/n3wscott/cloudevents-discovery"
+
+// Exporters are the supported values for Setup's exporter.
+var Exporters = []string{"none", "stdout", "otlp"}
+
+// Setup installs the global tracer provider for the exporter: "none" (or
+// empty) only propagates trace context, "stdout" writes spans to stdout and
+// "otlp" exports them over OTLP/HTTP, configured with the standard
+// OTEL_EXPORTER_OTLP_* environment variables. The returned func flushes and
+// stops the exporter.
+func Setup(ctx context.Context, exporter, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q, must be one of %v", exporter, Exporters)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the tracer for the server's spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Middleware starts a span for every request, continuing the trace from the
+// request's traceparent header. Spans are named by the mux route template.
+func Middleware(next http.Handler) http.Handler {
+	return otelhttp.NewMiddleware("http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if cr := mux.CurrentRoute(r); cr != nil {
+				if tpl, err := cr.GetPathTemplate(); err == nil {
+					return r.Method + " " + tpl
+				}
+			}
+			return r.Method
+		}),
+	)(next)
+}
+
+// Transport wraps base with a client span for every request and sets the
+// traceparent header.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
+
+const (
+	traceParent = "traceparent"
+	traceState  = "tracestate"
+)
+
+// InjectEvent sets the event's traceparent and tracestate extensions to the
+// span in ctx.
+func InjectEvent(ctx context.Context, e *event.Event) {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	if tp := carrier.Get(traceParent); tp != "" {
+		e.SetExtension(traceParent, tp)
+		if ts := carrier.Get(traceState); ts != "" {
+			e.SetExtension(traceState, ts)
+		}
+	}
+}
+
+// ExtractEvent returns ctx with the remote span from the event's traceparent
+// and tracestate extensions, if set.
+func ExtractEvent(ctx context.Context, e event.Event) context.Context {
+	carrier := propagation.MapCarrier{}
+	for _, name := range []string{traceParent, traceState} {
+		if v, ok := e.Extensions()[name].(string); ok {
+			carrier.Set(name, v)
+		}
+	}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
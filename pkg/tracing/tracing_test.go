@@ -0,0 +1,143 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	remoteParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	remoteTrace  = "4bf92f3577b34da6a3ce929d0e0e4736"
+)
+
+// recordSpans installs a tracer provider recording the spans ended during the
+// test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	prev, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return rec
+}
+
+func TestSetup(t *testing.T) {
+	// Setup installs globals, restored after the test.
+	recordSpans(t)
+	for _, exporter := range []string{"", "none", "stdout"} {
+		shutdown, err := Setup(context.Background(), exporter, "cloudmeta")
+		if err != nil {
+			t.Fatalf("exporter %q: %v", exporter, err)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("exporter %q: shutdown: %v", exporter, err)
+		}
+	}
+	if _, err := Setup(context.Background(), "jaeger", "cloudmeta"); err == nil {
+		t.Error("got no error for an unknown exporter")
+	}
+}
+
+func TestEventTraceContext(t *testing.T) {
+	recordSpans(t)
+	ctx, span := Tracer().Start(context.Background(), "send")
+	defer span.End()
+	ts, err := trace.ParseTraceState("vendor=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := span.SpanContext().WithTraceState(ts)
+	ctx = trace.ContextWithSpanContext(ctx, sc)
+
+	e := cloudevents.NewEvent()
+	InjectEvent(ctx, &e)
+	ext := e.Extensions()
+	if ext[traceParent] != "00-"+sc.TraceID().String()+"-"+sc.SpanID().String()+"-01" || ext[traceState] != "vendor=abc" {
+		t.Fatalf("got extensions %v for span %s", ext, sc.SpanID())
+	}
+
+	// The receiver continues the trace from the event.
+	got := trace.SpanContextFromContext(ExtractEvent(context.Background(), e))
+	if got.TraceID() != sc.TraceID() || got.SpanID() != sc.SpanID() || !got.IsRemote() || got.TraceState().String() != "vendor=abc" {
+		t.Errorf("extracted %+v, want the remote span %+v", got, sc)
+	}
+
+	// Without a span there is nothing to propagate.
+	plain := cloudevents.NewEvent()
+	InjectEvent(context.Background(), &plain)
+	if len(plain.Extensions()) != 0 {
+		t.Errorf("got extensions %v without a span", plain.Extensions())
+	}
+	if got := trace.SpanContextFromContext(ExtractEvent(context.Background(), plain)); got.IsValid() {
+		t.Errorf("extracted %+v from an event without trace context", got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	rec := recordSpans(t)
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/subscriptions/{id}", func(http.ResponseWriter, *http.Request) {})
+
+	req := httptest.NewRequest(http.MethodGet, "/subscriptions/abc", nil)
+	req.Header.Set(traceParent, remoteParent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if got := spans[0].Name(); got != "GET /subscriptions/{id}" {
+		t.Errorf("got span %q, want it named by the route", got)
+	}
+	if got := spans[0].Parent(); got.TraceID().String() != remoteTrace || !got.IsRemote() {
+		t.Errorf("got parent %+v, want the request's traceparent", got)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	rec := recordSpans(t)
+	var sent string
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get(traceParent)
+	}))
+	defer srv.Close()
+
+	ctx, span := Tracer().Start(context.Background(), "pull")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/services", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: Transport(http.DefaultTransport)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	span.End()
+
+	// The request carries the client span, a child of the pull.
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want the client span and the pull", len(spans))
+	}
+	client := spans[0]
+	if client.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("client span's parent is %s, want the pull %s", client.Parent().SpanID(), span.SpanContext().SpanID())
+	}
+	if want := "00-" + client.SpanContext().TraceID().String() + "-" + client.SpanContext().SpanID().String() + "-01"; sent != want {
+		t.Errorf("sent traceparent %q, want %q", sent, want)
+	}
+}